@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//AuthHMAC 使用挑战应答认证，令牌不在网络上传输
+const AuthHMAC = "hmac"
+
+//认证信息，使用cookie提交
+//hmac认证时先向云端获取挑战码，提交 HMAC-SHA256(令牌, endsn + "." + 账号 + "." + 挑战码)
+//挑战码只能使用一次，每个请求都需要重新获取
+func (b *BoxControl) authCookies() (cookies []*http.Cookie, err error) {
+	endsn := b.cfg.Equiment.EndSn
+	cookies = []*http.Cookie{
+		{Name: "account", Value: b.cfg.Secure.Account},
+		{Name: "endsn", Value: endsn},
+	}
+	if b.ctl.Auth != AuthHMAC {
+		cookies = append(cookies,
+			&http.Cookie{Name: "token", Value: b.cfg.Secure.EpeToken},
+			&http.Cookie{Name: "verify", Value: b.cfg.Secure.EpeVerify})
+		return
+	}
+	nonce, err := b.challenge(endsn)
+	if err != nil {
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(b.cfg.Secure.EpeToken))
+	mac.Write([]byte(endsn + "." + b.cfg.Secure.Account + "." + nonce))
+	cookies = append(cookies,
+		&http.Cookie{Name: "nonce", Value: nonce},
+		&http.Cookie{Name: "signature", Value: hex.EncodeToString(mac.Sum(nil))})
+	return
+}
+
+//向云端获取挑战码
+func (b *BoxControl) challenge(endsn string) (nonce string, err error) {
+	resp, err := b.client.Get(b.url("http", "/challenge?endsn="+url.QueryEscape(endsn)))
+	if err != nil {
+		err = fmt.Errorf("获取挑战码出错 %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	buff, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("读取挑战码出错 %v", err)
+		return
+	}
+	var res struct {
+		Code  string
+		Msg   string
+		Nonce string
+	}
+	if err = json.Unmarshal(buff, &res); err != nil {
+		err = fmt.Errorf("解析挑战码出错 %v", err)
+		return
+	}
+	if res.Code != "0000" {
+		err = fmt.Errorf("服务端返回错误[%s]", res.Msg)
+		return
+	}
+	return res.Nonce, nil
+}
+
+//生成带认证信息的请求
+func (b *BoxControl) newRequest(method, path string) (request *http.Request, err error) {
+	u := b.url("http", path)
+	request, err = http.NewRequest(method, u, nil)
+	if err != nil {
+		err = fmt.Errorf("%s %s 出错 %v", method, u, err)
+		return
+	}
+	cookies, err := b.authCookies()
+	if err != nil {
+		return
+	}
+	for _, c := range cookies {
+		request.AddCookie(c)
+	}
+	return
+}
+
+//websocket连接使用的请求头
+func (b *BoxControl) authHeader() (header http.Header, err error) {
+	cookies, err := b.authCookies()
+	if err != nil {
+		return
+	}
+	var pairs []string
+	for _, c := range cookies {
+		pairs = append(pairs, c.String())
+	}
+	header = make(http.Header)
+	header.Set("Cookie", strings.Join(pairs, "; "))
+	return
+}
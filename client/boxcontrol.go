@@ -2,15 +2,17 @@ package main
 
 import (
 	config "easy/box/boxconfig"
+	"easy/control/protocol"
+	"encoding/json"
+	"errors"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"fmt"
 
-	"encoding/json"
-
 	"os"
 	"os/exec"
 	"runtime"
@@ -20,46 +22,72 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	MethodHeart = iota + 1
-	MethodPullConfig
-	MethodPtyReq
-	MethodUpdate
-)
+//handler 处理云端请求，返回内容将作为返回报文的Body
+type handler func(msg *protocol.Message) (res interface{}, err error)
 
 //BoxControl 负责更新box配置
 //当收到云端推送的消息后，使用云端推送的url，
 //下载所需要的配置文件
 type BoxControl struct {
 	cfg *config.BoxConfig
+	//连接云端的配置
+	ctl *Config
+	//保护conn writer quit，重连时会被替换
+	mu *sync.Mutex
 	//此连接将发心跳保持
-	conn   *websocket.Conn
+	conn *websocket.Conn
+	//发送队列，所有写入由一个goroutine完成
+	writer *protocol.Writer
 	dialer *websocket.Dialer
-	header http.Header
 	//下载配置文件将使用http方式
 	client *http.Client
 	//状态 1为启动成功 0为未启动
 	status int32
 	quit   chan struct{}
 	//ssh client
-	sshClient  *sshClient
+	sshClient *sshClient
+	//支持的方法，握手时将上报给云端
+	handlers map[string]handler
+	//握手结果，为空时按旧版本协议通信，由mu保护
+	hello      *protocol.Hello
 	contextLog *log.Entry
 }
 
 //NewBoxControl ...
-func NewBoxControl(cfg *config.BoxConfig) *BoxControl {
+func NewBoxControl(cfg *config.BoxConfig, ctl *Config) (*BoxControl, error) {
+	tlsConfig, err := ctl.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
 	b := new(BoxControl)
 	b.cfg = cfg
+	b.ctl = ctl
+	b.mu = new(sync.Mutex)
 	b.client = new(http.Client)
 	b.client.Timeout = 5 * time.Minute
-	b.header = make(http.Header)
+	b.client.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
 	b.dialer = new(websocket.Dialer)
-	b.sshClient = newSSHClient(cfg)
+	b.dialer.TLSClientConfig = tlsConfig
+	b.sshClient = newSSHClient(cfg, ctl)
 	b.dialer.NetDial = func(network, addr string) (conn net.Conn, err error) {
 		return net.DialTimeout(network, addr, 5*time.Second)
 	}
+	b.handlers = map[string]handler{
+		protocol.MethodPullConfig: b.handlePullConfig,
+		protocol.MethodPtyReq:     b.handlePtyReq,
+		protocol.MethodUpdate:     b.handleUpdate,
+		protocol.MethodExec:       b.handleExec,
+	}
 	b.contextLog = logrus.WithFields(log.Fields{})
-	return b
+	return b, nil
+}
+
+//云端地址，启用TLS时使用wss和https
+func (b *BoxControl) url(scheme, path string) string {
+	if b.ctl.TLS {
+		scheme += "s"
+	}
+	return scheme + "://" + b.cfg.Update.Addr + path
 }
 
 //Start 开启服务将连接云端
@@ -75,25 +103,57 @@ func (b *BoxControl) start() (err error) {
 		err = fmt.Errorf("程序已经启动")
 		return err
 	}
-	if err := b.dial(); err != nil {
+	conn, hello, first, err := b.dial()
+	if err != nil {
 		err = fmt.Errorf("连接云端失败[%v]", err)
 		return err
 	}
-	b.quit = make(chan struct{})
-	go b.heartbeat()
+	writer := protocol.NewWriter(conn, 64)
+	quit := make(chan struct{})
+	b.mu.Lock()
+	b.conn = conn
+	b.writer = writer
+	b.quit = quit
+	b.hello = hello
+	b.mu.Unlock()
+	go b.heartbeat(conn, writer, quit)
+	//握手时收到的旧版本请求
+	if first != nil {
+		b.dispatch(writer, true, first)
+	}
 	b.poll()
 	return nil
 }
 
+//是否按旧版本协议通信
+func (b *BoxControl) isLegacy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.hello == nil
+}
+
+//当前的连接和发送队列
+func (b *BoxControl) current() (*websocket.Conn, *protocol.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn, b.writer
+}
+
 func (b *BoxControl) stop() (err error) {
 	if !atomic.CompareAndSwapInt32(&b.status, 1, 0) {
 		err = fmt.Errorf("程序已经停止")
 		return
 	}
-	if b.conn != nil {
-		b.conn.Close()
+	b.mu.Lock()
+	conn, writer, quit := b.conn, b.writer, b.quit
+	b.mu.Unlock()
+	if writer != nil {
+		writer.Close()
+	}
+	if conn != nil {
+		conn.Close()
 	}
-	close(b.quit)
+	close(quit)
 	return nil
 }
 
@@ -108,20 +168,42 @@ func (b *BoxControl) reconnect() (err error) {
 	return nil
 }
 
-func (b *BoxControl) dial() error {
+//云端没有返回握手报文，是不支持握手的旧版本云端
+var errNoHello = errors.New("云端未返回握手报文")
 
-	//重新加载配置
-	c := fmt.Sprintf("account=%s; token=%s; verify=%s; endsn=%s",
-		b.cfg.Secure.Account, b.cfg.Secure.EpeToken, b.cfg.Secure.EpeVerify, b.cfg.Equiment.EndSn)
-	b.header.Add("Cookie", c)
+//连接云端并握手，旧版本云端不返回握手报文，之后按旧版本协议重新连接
+//hello为空时按旧版本协议通信，first为握手时收到的旧版本请求
+func (b *BoxControl) dial() (conn *websocket.Conn, hello *protocol.Hello, first []byte, err error) {
 	var delay time.Duration
+	legacy := false
 	for {
 		b.contextLog.Infof("开始连接云端 %s", b.cfg.Update.Addr)
-		conn, _, err := b.dialer.Dial("ws://"+b.cfg.Update.Addr+"/control", b.header)
+		//每次连接重新生成认证信息
+		var header http.Header
+		header, err = b.authHeader()
 		if err == nil {
-			b.contextLog.Info("连接云端成功")
-			b.conn = conn
-			return nil
+			conn, _, err = b.dialer.Dial(b.url("ws", "/control"), header)
+		}
+		if err == nil {
+			if legacy {
+				b.contextLog.Info("连接云端成功,按旧版本协议通信")
+				return conn, nil, nil, nil
+			}
+			if hello, first, err = b.handshake(conn); err == nil {
+				if hello == nil {
+					b.contextLog.Info("连接云端成功,云端为旧版本")
+				} else {
+					b.contextLog.WithField("version", hello.Version).Info("连接云端成功")
+				}
+				return conn, hello, first, nil
+			}
+			conn.Close()
+			//超时后连接不能再读取，立即按旧版本协议重新连接
+			if err == errNoHello {
+				b.contextLog.Warnln("云端未返回握手报文,按旧版本协议重新连接")
+				legacy = true
+				continue
+			}
 		}
 		if delay == 0 {
 			delay = time.Second
@@ -136,119 +218,250 @@ func (b *BoxControl) dial() error {
 	}
 }
 
+//连接后首先上报协议版本和支持的方法，等待云端返回协商结果
+//旧版本云端不返回握手报文，超时返回errNoHello
+//收到旧版本请求时说明是旧版本云端，hello为空，请求由first返回
+func (b *BoxControl) handshake(conn *websocket.Conn) (hello *protocol.Hello, first []byte, err error) {
+	req := &protocol.Hello{Version: protocol.Version, Info: collectInfo()}
+	for method := range b.handlers {
+		req.Methods = append(req.Methods, method)
+	}
+	msg, err := protocol.NewMessage(protocol.TypeHello, 0, "", req)
+	if err != nil {
+		return
+	}
+	buff, err := protocol.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if err = conn.WriteMessage(websocket.TextMessage, buff); err != nil {
+		err = fmt.Errorf("写入握手报文出错 %v", err)
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, buff, err = conn.ReadMessage()
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			err = errNoHello
+			return
+		}
+		err = fmt.Errorf("读取握手报文出错 %v", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	//旧版本报文第一个字节为方法代码，不会是json
+	if len(buff) > 0 && buff[0] != '{' {
+		return nil, buff, nil
+	}
+	res, err := protocol.Unmarshal(buff)
+	if err != nil {
+		return
+	}
+	if res.Type != protocol.TypeHello {
+		err = fmt.Errorf("收到错误握手报文[%s]", res.Type)
+		return
+	}
+	if res.Error != nil {
+		err = fmt.Errorf("云端拒绝连接 %v", res.Error)
+		return
+	}
+	hello = new(protocol.Hello)
+	if err = res.Decode(hello); err != nil {
+		return
+	}
+	return
+}
+
 // 不断读取服务端传下来的报文
 func (b *BoxControl) poll() {
 	for {
-		code, msg, err := b.read()
+		conn, writer := b.current()
+		legacy := b.isLegacy()
+		buff, err := b.read(conn)
 		if err != nil {
 			b.contextLog.WithField("msg", "读取报文出错,开始重连").Errorln(err)
 			if err = b.reconnect(); err != nil {
 				b.contextLog.WithField("msg", "重连出错").Errorln(err)
-				continue
 			}
+			continue
 		}
-		b.process(code, msg)
+		b.dispatch(writer, legacy, buff)
 	}
 }
 
+//解析报文并处理，每个请求单独处理，不阻塞后续请求，返回写入收到请求的连接
+func (b *BoxControl) dispatch(writer *protocol.Writer, legacy bool, buff []byte) {
+	var msg *protocol.Message
+	var err error
+	if legacy {
+		msg, err = legacyRequest(buff)
+	} else {
+		msg, err = protocol.Unmarshal(buff)
+	}
+	if err != nil {
+		b.contextLog.WithField("msg", "解析报文").Errorln(err)
+		return
+	}
+	go b.process(writer, legacy, msg)
+}
+
+//将旧版本云端的请求转换为Message，第一个字节为方法代码，之后为json
+func legacyRequest(buff []byte) (msg *protocol.Message, err error) {
+	if len(buff) == 0 {
+		err = fmt.Errorf("收到空报文")
+		return
+	}
+	msg = &protocol.Message{Type: protocol.TypeRequest, Body: json.RawMessage(buff[1:])}
+	for method, code := range protocol.LegacyCodes {
+		if code == buff[0] {
+			msg.Method = method
+		}
+	}
+	if msg.Method == "" {
+		err = fmt.Errorf("未知的方法代码[%d]", buff[0])
+		return
+	}
+	if len(msg.Body) == 0 {
+		msg.Body = nil
+	}
+	return
+}
+
 // 每10秒发送一个心态报文
 // 如果2个心跳时长内没有收到报文则断开重连
-func (b *BoxControl) heartbeat() {
+// 每5分钟上报一次设备信息
+func (b *BoxControl) heartbeat(conn *websocket.Conn, writer *protocol.Writer, quit chan struct{}) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
+	infoTicker := time.NewTicker(5 * time.Minute)
+	defer infoTicker.Stop()
 
-	b.conn.SetReadDeadline(time.Now().Add(20 * time.Second))
-	b.conn.SetPongHandler(func(data string) error {
-		b.conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	conn.SetPongHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(20 * time.Second))
 		return nil
 	})
 	for {
 		select {
 		case <-ticker.C:
-			if err := b.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			if err := writer.WriteControl(websocket.PingMessage, []byte{}); err != nil {
 				b.contextLog.WithField("msg", "写入心跳报文出错").Errorln(err)
 			}
-		case <-b.quit:
+		case <-infoTicker.C:
+			if b.isLegacy() {
+				continue
+			}
+			if err := b.Publish(protocol.EventInfo, protocol.LevelInfo, "", collectInfo()); err != nil {
+				b.contextLog.WithField("msg", "上报设备信息出错").Errorln(err)
+			}
+		case <-quit:
 			return
 		}
 	}
 }
 
-/*
-	包结构
-	包类型1字节 + 包体
-*/
-func (b *BoxControl) read() (code byte, msg string, err error) {
-	_, buff, err := b.conn.ReadMessage()
-	if err != nil {
+func (b *BoxControl) read(conn *websocket.Conn) (buff []byte, err error) {
+	if _, buff, err = conn.ReadMessage(); err != nil {
 		err = fmt.Errorf("websocket ReadMessage 出错 %v", err)
-		return
 	}
-	//读取包类型
-	code = buff[0]
-	//读取包体
-	msg = string(buff[1:])
 	return
 }
 
-//报文类型 1心跳报文 2拉取配置报文，3发送盒子代码报文
-func (b *BoxControl) process(code byte, msg string) {
-	switch code {
-	case MethodPullConfig:
-		contextLog := b.contextLog.WithField("operate", "拉取配置")
-		contextLog.Info("收到报文")
-		if err := b.PullConfigAndUpdate(); err != nil {
-			contextLog.Errorln(err)
-			b.writeMsg(MethodPullConfig, err.Error())
-			return
-		}
-		if err := b.writeMsg(MethodPullConfig, "0000"); err != nil {
-			contextLog.WithField("msg", "写入返回").Errorln(err)
-		}
-	case MethodPtyReq:
-		contextLog := b.contextLog.WithField("operate", "建立终端请求")
-		contextLog.Info("收到报文")
-		var req struct {
-			Addr     string
-			User     string
-			Password string
-		}
-		if err := json.Unmarshal([]byte(msg), &req); err != nil {
-			contextLog.WithField("msg", "解析请求").Errorln(err)
-			b.writeMsg(MethodPtyReq, err.Error())
-			return
-		}
-		if err := b.sshClient.Start(req.Addr, req.User, req.Password); err != nil {
-			contextLog.WithField("msg", "启动终端").Errorln(err)
-			b.writeMsg(MethodPtyReq, err.Error())
-			return
-		}
-		if err := b.writeMsg(MethodPtyReq, "0000"); err != nil {
-			contextLog.WithField("msg", "写入返回").Errorln(err)
-		}
-	case MethodUpdate:
-		contextLog := b.contextLog.WithField("operate", "更新程序请求")
-		contextLog.Info("收到报文")
-		var req struct {
-			Version string
-		}
-		if err := json.Unmarshal([]byte(msg), &req); err != nil {
-			contextLog.WithField("msg", "解析请求").Errorln(err)
-			b.writeMsg(MethodPtyReq, err.Error())
-			return
+//根据方法找到对应的handler处理，并将结果返回给云端
+func (b *BoxControl) process(writer *protocol.Writer, legacy bool, msg *protocol.Message) {
+	contextLog := b.contextLog.WithFields(log.Fields{"operate": msg.Method, "id": msg.ID})
+	if msg.Type != protocol.TypeRequest {
+		contextLog.WithField("type", msg.Type).Info("未知报文类型,丢弃报文")
+		return
+	}
+	contextLog.Info("收到报文")
+	var res interface{}
+	var err error
+	if h, ok := b.handlers[msg.Method]; ok {
+		res, err = h(msg)
+	} else {
+		err = protocol.NewError(protocol.CodeUnsupported, "不支持此方法[%s]", msg.Method)
+	}
+	if err != nil {
+		contextLog.Errorln(err)
+		//旧版本云端不支持事件，错误只通过返回报文告知
+		if !legacy {
+			if e := b.Publish(protocol.EventError, protocol.LevelError, fmt.Sprintf("处理[%s]出错 %v", msg.Method, err), nil); e != nil {
+				contextLog.WithField("msg", "上报事件").Errorln(e)
+			}
 		}
-		if err := b.update(req.Version); err != nil {
-			contextLog.WithField("msg", "更新程序").Errorln(err)
-			b.writeMsg(MethodUpdate, err.Error())
-			return
+	}
+	if legacy {
+		err = b.replyLegacy(writer, msg, err)
+	} else {
+		err = b.reply(writer, msg, res, err)
+	}
+	if err != nil {
+		contextLog.WithField("msg", "写入返回").Errorln(err)
+	}
+}
+
+//拉取配置请求
+func (b *BoxControl) handlePullConfig(msg *protocol.Message) (res interface{}, err error) {
+	if err = b.PullConfigAndUpdate(); err != nil {
+		return
+	}
+	if e := b.Publish(protocol.EventConfigApplied, protocol.LevelInfo, "配置已经加载", nil); e != nil {
+		b.contextLog.WithField("msg", "上报事件").Errorln(e)
+	}
+	return
+}
+
+//建立终端请求
+func (b *BoxControl) handlePtyReq(msg *protocol.Message) (res interface{}, err error) {
+	req := new(protocol.PtyReq)
+	if err = msg.Decode(req); err != nil {
+		return
+	}
+	err = b.sshClient.Start(req)
+	if e, ok := err.(*hostKeyError); ok {
+		data := &protocol.HostKeyMismatch{Addr: req.Addr, Expected: e.Expected, Actual: e.Actual}
+		if e := b.Publish(protocol.EventHostKeyMismatch, protocol.LevelError, err.Error(), data); e != nil {
+			b.contextLog.WithField("msg", "上报事件").Errorln(e)
 		}
-		if err := b.writeMsg(MethodUpdate, "0000"); err != nil {
-			contextLog.WithField("msg", "写入返回").Errorln(err)
+		return nil, protocol.NewError(protocol.CodeHostKey, "%v", err)
+	}
+	if err != nil {
+		err = fmt.Errorf("启动终端出错 %v", err)
+	}
+	return
+}
+
+//更新程序请求
+func (b *BoxControl) handleUpdate(msg *protocol.Message) (res interface{}, err error) {
+	req := new(protocol.UpdateReq)
+	if err = msg.Decode(req); err != nil {
+		return
+	}
+	err = b.update(req.Version)
+	if e, ok := err.(*releaseError); ok {
+		if e := b.Publish(protocol.EventUpdateRejected, protocol.LevelError, err.Error(), req); e != nil {
+			b.contextLog.WithField("msg", "上报事件").Errorln(e)
 		}
+		return nil, protocol.NewError(protocol.CodeVerify, "%v", e)
+	}
+	if err != nil {
+		return
+	}
+	if e := b.Publish(protocol.EventUpdateStarted, protocol.LevelInfo, "开始更新程序", req); e != nil {
+		b.contextLog.WithField("msg", "上报事件").Errorln(e)
 	}
+	return
 }
+
 func (b *BoxControl) update(version string) (err error) {
-	if err = b.getBinFile(version); err != nil {
+	newName, info, err := b.getBinFile(version)
+	if err != nil {
+		return
+	}
+	//校验失败时删除文件，不启动更新
+	if err = verifyRelease(newName, version, info); err != nil {
+		os.Remove(newName)
 		return
 	}
 	var name string
@@ -283,12 +496,61 @@ func (b *BoxControl) PullConfig() (err error) {
 	return
 }
 
-func (b *BoxControl) writeMsg(code byte, msg string) (err error) {
-	buff := make([]byte, len(msg)+1)
-	buff[0] = code
-	copy(buff[1:], []byte(msg))
-	if err = b.conn.WriteMessage(websocket.TextMessage, buff); err != nil {
-		err = fmt.Errorf("websocket WriteMessage 出错 %v", err)
+//Publish 主动上报事件到云端，未连接云端时返回错误
+//data为附加数据，将被编码为json
+func (b *BoxControl) Publish(name, level, msg string, data interface{}) (err error) {
+	_, writer := b.current()
+	if atomic.LoadInt32(&b.status) != 1 || writer == nil {
+		err = fmt.Errorf("未连接云端")
+		return
+	}
+	if b.isLegacy() {
+		err = fmt.Errorf("旧版本云端不支持上报事件")
+		return
+	}
+	ev := &protocol.Event{Time: time.Now(), Level: level, Msg: msg}
+	if data != nil {
+		if ev.Data, err = json.Marshal(data); err != nil {
+			err = fmt.Errorf("json 打包出错 %v", err)
+			return
+		}
+	}
+	m, err := protocol.NewMessage(protocol.TypeEvent, 0, name, ev)
+	if err != nil {
+		return
+	}
+	return b.writeMsg(writer, m)
+}
+
+//将处理结果返回给云端，消息ID与请求相同
+func (b *BoxControl) reply(writer *protocol.Writer, req *protocol.Message, body interface{}, e error) (err error) {
+	msg, err := protocol.NewResponse(req, body, e)
+	if err != nil {
+		return
+	}
+	return b.writeMsg(writer, msg)
+}
+
+//旧版本协议的返回，第一个字节为方法代码，之后为0000或错误信息
+func (b *BoxControl) replyLegacy(writer *protocol.Writer, req *protocol.Message, e error) (err error) {
+	body := "0000"
+	if e != nil {
+		body = e.Error()
+	}
+	buff := append([]byte{protocol.LegacyCodes[req.Method]}, body...)
+	if err = writer.WriteMessage(websocket.TextMessage, buff); err != nil {
+		err = fmt.Errorf("写入发送队列出错 %v", err)
+	}
+	return
+}
+
+func (b *BoxControl) writeMsg(writer *protocol.Writer, msg *protocol.Message) (err error) {
+	buff, err := protocol.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if err = writer.WriteMessage(websocket.TextMessage, buff); err != nil {
+		err = fmt.Errorf("写入发送队列出错 %v", err)
 	}
 	return
 }
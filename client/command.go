@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"easy/control/protocol"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+//limitBuffer 只保留前max个字节的输出，超出部分丢弃
+//输出由单独的goroutine写入，读取前需要加锁
+type limitBuffer struct {
+	mu        *sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+	//停止后的输出全部丢弃
+	stopped bool
+}
+
+func newLimitBuffer(max int) *limitBuffer {
+	b := new(limitBuffer)
+	b.mu = new(sync.Mutex)
+	b.max = max
+	return b
+}
+
+func (b *limitBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return len(p), nil
+	}
+	if n := b.max - b.buf.Len(); n < len(p) {
+		b.truncated = true
+		if n > 0 {
+			b.buf.Write(p[:n])
+		}
+		//返回全部长度，避免命令因写入出错退出
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+//返回输出和编码，不是有效的UTF-8时使用base64编码
+//截断的位置在字符中间时去掉不完整的字符，避免文本输出被编码
+func (b *limitBuffer) encode() (s, encoding string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = true
+	data := b.buf.Bytes()
+	if b.truncated {
+		for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(data[i]) {
+				if !utf8.FullRune(data[i:]) {
+					data = data[:i]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), protocol.ExecEncodingBase64
+}
+
+//outputPipe 命令的输出管道，命令退出后后台子进程可能仍然占用
+type outputPipe struct {
+	r, w *os.File
+	done chan struct{}
+}
+
+//建立管道并开始读取，输出写入buf
+func newOutputPipe(buf *limitBuffer) (p *outputPipe, err error) {
+	p = &outputPipe{done: make(chan struct{})}
+	if p.r, p.w, err = os.Pipe(); err != nil {
+		err = fmt.Errorf("建立管道出错 %v", err)
+		return
+	}
+	go func() {
+		io.Copy(buf, p.r)
+		close(p.done)
+	}()
+	return
+}
+
+//等待输出读取完成，超过deadline后关闭管道，不再等待占用管道的子进程
+func (p *outputPipe) wait(deadline time.Time) {
+	select {
+	case <-p.done:
+	case <-time.After(time.Until(deadline)):
+	}
+	p.r.Close()
+}
+
+//执行命令请求
+func (b *BoxControl) handleExec(msg *protocol.Message) (res interface{}, err error) {
+	req := new(protocol.ExecReq)
+	if err = msg.Decode(req); err != nil {
+		return nil, protocol.NewError(protocol.CodeBadRequest, "%v", err)
+	}
+	if req.Command == "" {
+		return nil, protocol.NewError(protocol.CodeBadRequest, "命令不能为空")
+	}
+	b.contextLog.WithField("command", req.Command).Info("执行命令")
+	r, err := runCommand(req)
+	if err != nil {
+		return
+	}
+	return r, nil
+}
+
+//使用系统shell执行命令，超时后结束命令及其子进程
+//输出使用管道读取，命令退出后后台子进程仍占用输出时，最多等待ExecWaitDelay后关闭管道
+//命令无法启动时返回错误，命令执行失败时通过退出码返回
+func runCommand(req *protocol.ExecReq) (res *protocol.ExecRes, err error) {
+	cmd := shellCommand(req.Command)
+	cmd.Dir = req.Dir
+	cmd.Env = append(os.Environ(), req.Env...)
+	stdout := newLimitBuffer(protocol.ExecMaxOutput)
+	stderr := newLimitBuffer(protocol.ExecMaxOutput)
+	outPipe, err := newOutputPipe(stdout)
+	if err != nil {
+		return
+	}
+	errPipe, err := newOutputPipe(stderr)
+	if err != nil {
+		outPipe.w.Close()
+		outPipe.r.Close()
+		return
+	}
+	//输出为*os.File时Wait只等待命令退出，不等待管道读取完成
+	cmd.Stdout = outPipe.w
+	cmd.Stderr = errPipe.w
+
+	start := time.Now()
+	err = cmd.Start()
+	//子进程已经继承写入端，关闭本进程的写入端，命令及其子进程全部退出后读取结束
+	outPipe.w.Close()
+	errPipe.w.Close()
+	if err != nil {
+		outPipe.r.Close()
+		errPipe.r.Close()
+		err = fmt.Errorf("启动命令出错 %v", err)
+		return
+	}
+	var timedOut int32
+	timer := time.AfterFunc(req.TimeoutDuration(), func() {
+		atomic.StoreInt32(&timedOut, 1)
+		killCommand(cmd)
+	})
+	err = cmd.Wait()
+	timer.Stop()
+	deadline := time.Now().Add(protocol.ExecWaitDelay)
+	outPipe.wait(deadline)
+	errPipe.wait(deadline)
+	res = new(protocol.ExecRes)
+	res.TimedOut = atomic.LoadInt32(&timedOut) == 1
+	res.Duration = int64(time.Since(start) / time.Millisecond)
+	res.Stdout, res.StdoutEncoding = stdout.encode()
+	res.Stderr, res.StderrEncoding = stderr.encode()
+	res.StdoutTruncated = stdout.truncated
+	res.StderrTruncated = stderr.truncated
+	res.ExitCode = cmd.ProcessState.ExitCode()
+	if _, ok := err.(*exec.ExitError); ok {
+		err = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("执行命令出错 %v", err)
+	}
+	return
+}
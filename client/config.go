@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+//Config 连接云端的配置，使用json格式保存
+//box.conf由box程序维护，这里只保存控制程序自己的配置
+//配置文件不存在时使用默认配置
+type Config struct {
+	//使用wss和https连接云端
+	TLS bool
+	//云端证书的CA，配置后只信任此CA签发的证书，为空时使用系统CA
+	CA string
+	//box证书和私钥，云端开启证书认证时需要，证书CN必须为endsn
+	Cert string
+	Key  string
+	//认证方式，为hmac时使用挑战应答，否则直接提交令牌
+	Auth string
+	//固定的ssh服务端主机密钥指纹，格式为 SHA256:base64
+	//配置后云端下发的指纹也必须与此一致
+	SSHHostKey string
+	//终端空闲超时和最长时长，单位分钟，为0时不限制
+	//云端下发超时时以较小的为准
+	TerminalIdle int
+	TerminalMax  int
+}
+
+//LoadConfig 读取配置文件
+func LoadConfig(filename string) (cfg *Config, err error) {
+	cfg = new(Config)
+	buff, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		err = fmt.Errorf("读取配置文件出错 %v", err)
+		return
+	}
+	if err = json.Unmarshal(buff, cfg); err != nil {
+		err = fmt.Errorf("解析配置文件出错 %v", err)
+	}
+	return
+}
+
+//生成连接云端的TLS配置，未启用TLS时返回nil
+func (c *Config) tlsConfig() (cfg *tls.Config, err error) {
+	if !c.TLS {
+		return nil, nil
+	}
+	cfg = new(tls.Config)
+	cfg.MinVersion = tls.VersionTLS12
+	if c.CA != "" {
+		buff, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("读取CA证书出错 %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buff) {
+			return nil, fmt.Errorf("CA证书 %s 格式错误", c.CA)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("加载box证书出错 %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
@@ -0,0 +1,20 @@
+// +build linux darwin
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+//使用/bin/sh执行命令，命令在新的进程组中运行，超时时结束整个进程组
+func shellCommand(command string) *exec.Cmd {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+//结束命令及其子进程
+func killCommand(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+//使用cmd执行命令
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/c", command)
+}
+
+//结束命令及其子进程
+func killCommand(cmd *exec.Cmd) {
+	exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
 	"runtime"
 	"time"
@@ -20,25 +19,27 @@ type fileInfo struct {
 	URL     string
 	Version string
 	MD5     string
+	//更新文件的SHA-256和签名
+	SHA256    string
+	Signature string
 }
 
 //获取流程：首先获取最新版本号，然后下载文件。
 //下载的文件会保存在当前目录下, 文件名为时间戳.db
 func (b *BoxControl) getDbFileAndReplace() (err error) {
-	request, err := http.NewRequest("POST", "http://"+b.cfg.Update.Addr+"/dbfile", nil)
+	request, err := b.newRequest("POST", "/dbfile")
 	if err != nil {
-		err = fmt.Errorf("POST %s 出错 %v", request.RequestURI, err)
 		return
 	}
-	request.AddCookie(&http.Cookie{Name: "account", Value: b.cfg.Secure.Account})
-	request.AddCookie(&http.Cookie{Name: "token", Value: b.cfg.Secure.EpeToken})
-	request.AddCookie(&http.Cookie{Name: "verify", Value: b.cfg.Secure.EpeVerify})
-	request.AddCookie(&http.Cookie{Name: "endsn", Value: b.cfg.Equiment.EndSn})
 	//首先获取当前EndSn下最新数据库版本和MD5
 	fileInfo, err := b.getFileInfo(request)
 	if err != nil {
 		return
 	}
+	//挑战码只能使用一次，下载时重新生成认证信息
+	if request, err = b.newRequest("GET", "/dbfile"); err != nil {
+		return
+	}
 	//下载文件
 	newName := fmt.Sprintf("%d.db", time.Now().Unix())
 	err = b.getFile(request, fileInfo.MD5, newName, true)
@@ -49,10 +50,10 @@ func (b *BoxControl) getDbFileAndReplace() (err error) {
 	return
 }
 
-func (b *BoxControl) getBinFile(version string) (err error) {
-	request, err := http.NewRequest("POST", "http://"+b.cfg.Update.Addr+"/binfile", nil)
+//下载更新文件，返回文件名和服务端返回的签名信息
+func (b *BoxControl) getBinFile(version string) (newName string, info *fileInfo, err error) {
+	request, err := b.newRequest("POST", "/binfile")
 	if err != nil {
-		err = fmt.Errorf("POST %s 出错 %v", request.RequestURI, err)
 		return
 	}
 	request.AddCookie(&http.Cookie{Name: "GOOS", Value: runtime.GOOS})
@@ -60,29 +61,23 @@ func (b *BoxControl) getBinFile(version string) (err error) {
 	request.AddCookie(&http.Cookie{Name: "Version", Value: version})
 	request.AddCookie(&http.Cookie{Name: "EndSn", Value: b.cfg.Equiment.EndSn})
 
-	fileInfo, err := b.getFileInfo(request)
-	if err != nil {
+	if info, err = b.getFileInfo(request); err != nil {
 		return
 	}
 	//下载文件
-	var newName string
 	if runtime.GOOS == "windows" {
 		newName = "box-new.exe"
 	} else {
 		newName = "box-new"
 	}
-	u, err := url.Parse(fileInfo.URL)
-	if err != nil {
+	//从CDN下载，不发送认证信息
+	if request, err = http.NewRequest("GET", info.URL, nil); err != nil {
 		err = fmt.Errorf("解析下载链接出错 %v", err)
 		return
 	}
-	request.URL = u
 	request.Host = "aliyun.cdn.yireyun.com"
-	b.contextLog.WithField("url", fileInfo.URL).Info("开始下载文件")
-	err = b.getFile(request, fileInfo.MD5, newName, false)
-	if err != nil {
-		return
-	}
+	b.contextLog.WithField("url", info.URL).Info("开始下载文件")
+	err = b.getFile(request, info.MD5, newName, false)
 	return
 }
 
@@ -174,19 +169,29 @@ func (b *BoxControl) replaceFile(srcfile, dstfile string) (err error) {
 }
 
 //将srcfile替换为dstfile,并备份srcfile
+//重命名失败并且srcfile已经不存在时从备份恢复，避免box没有可以运行的文件
 func replaceFile(srcfile, dstfile string) (err error) {
-	newName := fmt.Sprintf("backup/%s.%s", srcfile, time.Now().Format("2006-01-02|15:04:05"))
+	newName := fmt.Sprintf("backup/%s.%s", srcfile, time.Now().Format("20060102150405"))
 	buff, err := ioutil.ReadFile(srcfile)
 	if err != nil {
 		err = fmt.Errorf("读取文件 %s 出错 %v", srcfile, err)
 		return
 	}
+	if err = os.MkdirAll("backup", 0755); err != nil {
+		err = fmt.Errorf("建立文件夹出错 %v", err)
+		return
+	}
 	if err = ioutil.WriteFile(newName, buff, 0770); err != nil {
 		err = fmt.Errorf("写入文件 %s 出错 %v", newName, err)
 		return
 	}
 	if err = os.Rename(dstfile, srcfile); err != nil {
 		err = fmt.Errorf("重命名文件 %s -> %s 出错 %v", dstfile, srcfile, err)
+		if _, e := os.Stat(srcfile); e != nil {
+			if e = ioutil.WriteFile(srcfile, buff, 0770); e != nil {
+				err = fmt.Errorf("%v, 从备份 %s 恢复出错 %v", err, newName, e)
+			}
+		}
 	}
 	return
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//hostKeyError ssh服务端主机密钥与期望的不一致
+type hostKeyError struct {
+	Expected []string
+	Actual   string
+}
+
+func (e *hostKeyError) Error() string {
+	if len(e.Expected) == 0 {
+		return fmt.Sprintf("未配置ssh主机密钥，拒绝连接 %s", e.Actual)
+	}
+	return fmt.Sprintf("ssh主机密钥不一致，期望 %s 实际 %s", strings.Join(e.Expected, ","), e.Actual)
+}
+
+//校验主机密钥指纹，pinned为本地配置，delivered为云端下发
+//配置了的指纹都必须一致，都没有配置时拒绝连接
+func checkHostKey(pinned, delivered, actual string) error {
+	var expected []string
+	for _, fp := range []string{pinned, delivered} {
+		if fp != "" {
+			expected = append(expected, fp)
+		}
+	}
+	if len(expected) == 0 {
+		return &hostKeyError{Actual: actual}
+	}
+	for _, fp := range expected {
+		if fp != actual {
+			return &hostKeyError{Expected: expected, Actual: actual}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/md5"
+	"easy/control/protocol"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"time"
+)
+
+//Version 程序版本，编译时使用 -ldflags "-X main.Version=x.x.x" 指定
+var Version = "dev"
+
+//采集设备信息，采集失败的项目将为空
+func collectInfo() *protocol.BoxInfo {
+	info := new(protocol.BoxInfo)
+	info.Version = Version
+	info.GOOS = runtime.GOOS
+	info.GOARCH = runtime.GOARCH
+	info.Hostname, _ = os.Hostname()
+	info.Kernel = kernelVersion()
+	info.Uptime = int64(uptime() / time.Second)
+	info.IPs = localIPs()
+	if buff, err := ioutil.ReadFile("easy.db"); err == nil {
+		v := md5.Sum(buff)
+		info.ConfigMD5 = hex.EncodeToString(v[:])
+	}
+	info.Time = time.Now()
+	return info
+}
+
+//获取本地非回环地址
+func localIPs() (ips []string) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return
+	}
+	for _, addr := range addrs {
+		if v, ok := addr.(*net.IPNet); ok && !v.IP.IsLoopback() {
+			ips = append(ips, v.IP.String())
+		}
+	}
+	return
+}
@@ -12,6 +12,15 @@ func main() {
 		log.Println("加载配置文件出错", err)
 		return
 	}
-	b := NewBoxControl(cfg)
+	ctl, err := LoadConfig("control.conf")
+	if err != nil {
+		log.Println("加载配置文件出错", err)
+		return
+	}
+	b, err := NewBoxControl(cfg, ctl)
+	if err != nil {
+		log.Println("初始化出错", err)
+		return
+	}
 	log.Fatalln(b.Start())
 }
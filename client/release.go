@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"easy/control/protocol"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+)
+
+//ReleaseKey 发布文件签名公钥，base64格式
+//编译时使用 -ldflags "-X main.ReleaseKey=xxx" 指定，未指定时拒绝所有更新
+var ReleaseKey = ""
+
+//releaseError 更新文件校验失败
+type releaseError struct {
+	msg string
+}
+
+func (e *releaseError) Error() string {
+	return "更新文件校验失败 " + e.msg
+}
+
+//校验下载的更新文件，签名和SHA-256都必须正确
+func verifyRelease(filename, version string, info *fileInfo) error {
+	key, err := base64.StdEncoding.DecodeString(ReleaseKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return &releaseError{"未配置发布公钥"}
+	}
+	buff, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("读取文件 %s 出错 %v", filename, err)
+	}
+	expect, err := hex.DecodeString(info.SHA256)
+	if err != nil {
+		return &releaseError{fmt.Sprintf("SHA256格式错误 %v", err)}
+	}
+	sum := sha256.Sum256(buff)
+	if !bytes.Equal(expect, sum[:]) {
+		return &releaseError{"SHA256不一致"}
+	}
+	//签名内容使用box自己的平台和请求的版本，防止使用其他平台或版本的签名
+	r := &protocol.Release{
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		Version:   version,
+		SHA256:    hex.EncodeToString(sum[:]),
+		Signature: info.Signature,
+	}
+	if err = r.Verify(ed25519.PublicKey(key)); err != nil {
+		return &releaseError{err.Error()}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"net"
+	"sync"
 	"time"
 
 	"fmt"
@@ -14,83 +15,165 @@ import (
 	"io"
 
 	"sync/atomic"
+	"syscall"
 
 	"easy/box/boxconfig"
+	"easy/control/protocol"
 
 	"github.com/kr/pty"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
-//SSHClient ssh客户端,连接成功后将接收终端请求.
-//如果再次收到连接请求,将关闭以前的.
+//SSHClient ssh客户端,每个终端会话单独连接服务端并建立伪终端.
+//会话之间互不影响,任何一端关闭只结束对应的会话.
 type sshClient struct {
-	conn       ssh.Conn
-	status     int32
+	mu *sync.Mutex
+	//终端会话，主键为会话ID
+	sessions   map[string]*ptySession
 	cfg        *boxconfig.BoxConfig
-	p          *os.File
+	ctl        *Config
 	contextLog *logrus.Entry
 }
 
-func newSSHClient(cfg *boxconfig.BoxConfig) *sshClient {
+//ptySession 一个终端会话的连接、管道和伪终端
+type ptySession struct {
+	id      string
+	conn    ssh.Conn
+	channel ssh.Channel
+	p       *os.File
+	cmd     *exec.Cmd
+	once    *sync.Once
+	//会话关闭时关闭
+	done chan struct{}
+	//建立时间和最后一次输入的时间，单位纳秒
+	start     time.Time
+	lastInput int64
+}
+
+func newSSHClient(cfg *boxconfig.BoxConfig, ctl *Config) *sshClient {
 	s := new(sshClient)
+	s.mu = new(sync.Mutex)
+	s.sessions = make(map[string]*ptySession)
 	s.cfg = cfg
+	s.ctl = ctl
 	s.contextLog = logrus.WithField("module", "ssh")
 	return s
 }
 
-//Start 开始连接服务端,出错将不会重连直接返回错误.
-//用户名密码是服务端传过来临时的
-func (s *sshClient) Start(addr, user, password string) (err error) {
-	s.contextLog.Info("清理ssh客户端")
-	s.stop()
-	s.contextLog.Info("开始启动ssh客户端")
-	err = s.start(addr, user, password)
+//Start 为终端会话连接服务端,出错将不会重连直接返回错误.
+//用户名密码是服务端传过来临时的，HostKey为服务端下发的主机密钥指纹
+//Session为终端会话ID，旧版本服务端不发送时使用临时用户名
+//主机密钥不一致时返回*hostKeyError
+func (s *sshClient) Start(req *protocol.PtyReq) (err error) {
+	session := req.Session
+	if session == "" {
+		session = req.User
+	}
+	s.contextLog.WithField("session", session).Info("开始启动ssh客户端")
+	sess, err := s.start(req.Addr, req.User, req.Password, req.HostKey, session)
+	if err != nil {
+		return
+	}
+	idle := termLimit(req.IdleTimeout, s.ctl.TerminalIdle)
+	maxDuration := termLimit(req.MaxDuration, s.ctl.TerminalMax)
+	if idle > 0 || maxDuration > 0 {
+		go s.watch(sess, idle, maxDuration)
+	}
 	return
 }
 
-func (s *sshClient) stop() {
-	//如果已经启动将关闭以前的,重新开始
-	if atomic.LoadInt32(&s.status) == 1 {
-		if s.conn != nil {
-			s.conn.Close()
+//关闭终端会话，结束shell并删除会话
+func (s *sshClient) close(sess *ptySession) {
+	sess.once.Do(func() {
+		close(sess.done)
+		s.mu.Lock()
+		delete(s.sessions, sess.id)
+		s.mu.Unlock()
+		if sess.channel != nil {
+			sess.channel.Close()
 		}
-		if s.p != nil {
-			s.p.Write([]byte("exit\n"))
-			s.p.Close()
+		sess.conn.Close()
+		if sess.cmd != nil {
+			//shell是新会话和进程组的首进程，结束整个进程组
+			//先发送SIGHUP，shell退出前会转发给在其它进程组中的后台任务
+			pid := sess.cmd.Process.Pid
+			syscall.Kill(-pid, syscall.SIGHUP)
+			exited := make(chan struct{})
+			go func() {
+				sess.cmd.Wait()
+				close(exited)
+			}()
+			select {
+			case <-exited:
+			case <-time.After(time.Second):
+			}
+			syscall.Kill(-pid, syscall.SIGKILL)
+			sess.p.Close()
+			<-exited
 		}
-	}
-	atomic.StoreInt32(&s.status, 0)
+		s.contextLog.WithField("session", sess.id).Info("终端会话已经关闭")
+	})
 }
-func (s *sshClient) start(addr, user, password string) (err error) {
+
+func (s *sshClient) start(addr, user, password, hostKey, session string) (sess *ptySession, err error) {
 	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
 	if err != nil {
 		err = fmt.Errorf("dial %s 出错 %v", addr, err)
 		return
 	}
-	atomic.StoreInt32(&s.status, 1)
 
+	//握手出错时返回的错误不一定保留原始错误，这里单独记录
+	var mismatch error
 	config := &ssh.ClientConfig{
 		User: user,
 		Auth: []ssh.AuthMethod{
 			ssh.Password(password),
 		},
 		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
+			mismatch = checkHostKey(s.ctl.SSHHostKey, hostKey, ssh.FingerprintSHA256(key))
+			return mismatch
 		},
 	}
-	cConn, _, _, err := ssh.NewClientConn(conn, addr, config)
+	cConn, chans, gReqs, err := ssh.NewClientConn(conn, addr, config)
+	if mismatch != nil {
+		conn.Close()
+		return nil, mismatch
+	}
 	if err != nil {
 		err = fmt.Errorf("ssh new sshclient 出错 %v", err)
 		return
 	}
+	go ssh.DiscardRequests(gReqs)
+	go func() {
+		for c := range chans {
+			c.Reject(ssh.Prohibited, "not supported")
+		}
+	}()
+	sess = &ptySession{id: session, conn: cConn, once: new(sync.Once), done: make(chan struct{}), start: time.Now()}
+	sess.lastInput = sess.start.UnixNano()
+	s.mu.Lock()
+	if _, ok := s.sessions[session]; ok {
+		s.mu.Unlock()
+		cConn.Close()
+		err = fmt.Errorf("终端会话[%s]已经存在", session)
+		return
+	}
+	s.sessions[session] = sess
+	s.mu.Unlock()
+	//建立终端失败时关闭会话
+	defer func() {
+		if err != nil {
+			s.close(sess)
+		}
+	}()
 	//开始创建终端通讯管道
 	channel, reqs, err := cConn.OpenChannel(s.cfg.Equiment.EndSn, nil)
 	if err != nil {
 		err = fmt.Errorf("ssh openChannel 出错 %v", err)
 		return
 	}
+	sess.channel = channel
 
 	//开始等待服务端传送过来的创建伪终端请求
 	var pytReq struct {
@@ -118,14 +201,18 @@ func (s *sshClient) start(addr, user, password string) (err error) {
 	env := os.Environ()
 	cmd := exec.Command("/bin/bash")
 	cmd.Env = env
+	//在新的会话中运行，进程组ID与shell的pid相同，关闭时结束整个进程组
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 	p, err := pty.Start(cmd)
 	if err != nil {
 		err = fmt.Errorf("启动伪终端失败 %v", err)
 		return
 	}
-	s.p = p
-	term := terminal.NewTerminal(p, "")
-	term.SetSize(int(pytReq.Width), int(pytReq.Heigth))
+	sess.p = p
+	sess.cmd = cmd
+	if err := setSize(p, pytReq.Width, pytReq.Heigth); err != nil {
+		s.contextLog.WithField("msg", "设置终端大小").Errorln(err)
+	}
 	//开始等待服务端shell请求
 	for req := range reqs {
 		if req.Type != "shell" {
@@ -135,17 +222,117 @@ func (s *sshClient) start(addr, user, password string) (err error) {
 			break
 		}
 	}
+	//网页终端大小变化时服务端将发送window-change
+	go s.handleRequests(p, reqs)
+	//shell退出或服务端关闭管道时关闭会话
 	go func() {
+		defer s.close(sess)
 		if _, err := io.Copy(channel, p); err != nil {
 			s.contextLog.WithField("msg", "copy(channel, p)").Errorln(err)
 			return
 		}
 	}()
 	go func() {
-		if _, err := io.Copy(p, channel); err != nil {
+		defer s.close(sess)
+		if _, err := io.Copy(p, &inputReader{channel, &sess.lastInput}); err != nil {
 			s.contextLog.WithField("msg", "copy(p, channel)").Errorln(err)
 			return
 		}
 	}()
 	return
 }
+
+//windowChange ssh window-change请求，见RFC 4254 6.7
+type windowChange struct {
+	Cols   uint32
+	Rows   uint32
+	Width  uint32
+	Height uint32
+}
+
+//处理shell启动后服务端发送的请求
+func (s *sshClient) handleRequests(p *os.File, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type != "window-change" {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+		var wc windowChange
+		err := ssh.Unmarshal(req.Payload, &wc)
+		if err == nil {
+			err = setSize(p, wc.Cols, wc.Rows)
+		}
+		if err != nil {
+			s.contextLog.WithField("msg", "修改终端大小").Errorln(err)
+		}
+		if req.WantReply {
+			req.Reply(err == nil, nil)
+		}
+	}
+}
+
+//修改伪终端大小
+func setSize(p *os.File, cols, rows uint32) error {
+	if cols == 0 || rows == 0 || cols > 0xffff || rows > 0xffff {
+		return fmt.Errorf("终端大小错误 %dx%d", cols, rows)
+	}
+	return pty.Setsize(p, &pty.Winsize{Cols: uint16(cols), Rows: uint16(rows)})
+}
+
+//记录最后一次输入时间的reader
+type inputReader struct {
+	r    io.Reader
+	last *int64
+}
+
+func (r *inputReader) Read(b []byte) (n int, err error) {
+	n, err = r.r.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(r.last, time.Now().UnixNano())
+	}
+	return
+}
+
+//终端超时时长，remote为云端下发的秒数，local为本地配置的分钟数
+//都配置时以较小的为准，为0时不限制
+//云端会先断开并提示网页，这里多等待termGrace作为云端异常时的保护
+func termLimit(remote, local int) time.Duration {
+	d := time.Duration(remote) * time.Second
+	if l := time.Duration(local) * time.Minute; l > 0 && (d == 0 || l < d) {
+		d = l
+	}
+	if d > 0 {
+		d += termGrace
+	}
+	return d
+}
+
+//本地超时检查比云端晚的时间
+const termGrace = time.Minute
+
+//定时检查终端会话，空闲或打开时间超过限制时关闭会话并结束shell
+func (s *sshClient) watch(sess *ptySession, idle, maxDuration time.Duration) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-ticker.C:
+		}
+		var reason string
+		if idle > 0 && time.Since(time.Unix(0, atomic.LoadInt64(&sess.lastInput))) > idle {
+			reason = "空闲超时"
+		}
+		if maxDuration > 0 && time.Since(sess.start) > maxDuration {
+			reason = "超过最长时长"
+		}
+		if reason != "" {
+			s.contextLog.WithField("session", sess.id).Warnln("终端" + reason + "，关闭会话")
+			s.close(sess)
+			return
+		}
+	}
+}
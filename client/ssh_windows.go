@@ -2,17 +2,18 @@ package main
 
 import (
 	"easy/box/boxconfig"
+	"easy/control/protocol"
 	"fmt"
 )
 
 type sshClient struct {
 }
 
-func newSSHClient(cfg *boxconfig.BoxConfig) *sshClient {
+func newSSHClient(cfg *boxconfig.BoxConfig, ctl *Config) *sshClient {
 	s := new(sshClient)
 	return s
 }
-func (s *sshClient) Start(addr, user, password string) (err error) {
+func (s *sshClient) Start(req *protocol.PtyReq) (err error) {
 	err = fmt.Errorf("windows 暂不支持此功能")
 	return
 }
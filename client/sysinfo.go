@@ -0,0 +1,37 @@
+// +build linux darwin
+
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//内核版本，使用uname -r获取
+func kernelVersion() string {
+	out, err := exec.Command("uname", "-r").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+//开机时长，从/proc/uptime读取，darwin下为0
+func uptime() time.Duration {
+	buff, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(buff))
+	if len(fields) == 0 {
+		return 0
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(v * float64(time.Second))
+}
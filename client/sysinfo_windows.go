@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"time"
+)
+
+//内核版本，使用ver获取
+func kernelVersion() string {
+	out, err := exec.Command("cmd", "/c", "ver").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+//windows 暂不支持获取开机时长
+func uptime() time.Duration {
+	return 0
+}
@@ -30,9 +30,9 @@ func update() {
 	}
 	//替换并备份原来的文件
 	log.Info("开始替换并备份文件")
+	//替换失败时原文件已经恢复，仍然需要重新启动box
 	if err := replaceFile("box", "box-new"); err != nil {
 		log.WithField("msg", "替换文件失败").Errorln(err)
-		return
 	}
 	//启动box
 	log.Info("开始启动box")
@@ -85,11 +85,12 @@ func update() {
 	log.Println("关闭box成功")
 	//替换并备份原来的文件
 	log.Println("开始替换和备份文件")
+	//替换失败时原文件已经恢复，仍然需要重新启动box
 	if err := replaceFile("box.exe", "box-new.exe"); err != nil {
 		log.Println(err)
-		return
+	} else {
+		log.Println("替换和备份文件成功")
 	}
-	log.Println("替换和备份文件成功")
 	//启动box
 	log.Println("开始停止box")
 	cmd = exec.Command("schtasks", "/run", "/tn", "box")
@@ -0,0 +1,314 @@
+//Package protocol 定义云端与box之间控制通道的报文格式
+//云端和box共用此包，保证两端的报文定义一致
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	//Version 当前协议版本
+	Version = 1
+	//MinVersion 云端可以接受的最低协议版本
+	//低于此版本的box将被拒绝，未进行握手的box按旧版本处理
+	MinVersion = 1
+)
+
+//报文类型
+const (
+	//TypeHello box连接后首先发送，云端返回协商结果
+	TypeHello = "hello"
+	//TypeRequest 云端发往box的请求
+	TypeRequest = "request"
+	//TypeResponse box对请求的返回，ID与请求相同
+	TypeResponse = "response"
+	//TypeEvent box主动上报的事件，Method为事件名称，不需要返回
+	TypeEvent = "event"
+)
+
+//方法名称
+const (
+	MethodPullConfig = "pullconfig"
+	MethodPtyReq     = "ptyreq"
+	MethodUpdate     = "update"
+	MethodExec       = "exec"
+)
+
+//Methods 当前协议版本定义的全部方法
+var Methods = []string{
+	MethodPullConfig,
+	MethodPtyReq,
+	MethodUpdate,
+	MethodExec,
+}
+
+//事件名称
+const (
+	//EventConfigApplied 配置已经加载
+	EventConfigApplied = "config.applied"
+	//EventUpdateStarted 更新文件下载完成，开始替换程序
+	EventUpdateStarted = "update.started"
+	//EventUpdateRejected 更新文件签名或SHA-256校验失败，没有替换程序
+	EventUpdateRejected = "update.rejected"
+	//EventError box运行出错
+	EventError = "error"
+	//EventAlarm box本地告警
+	EventAlarm = "alarm"
+	//EventInfo box定时上报设备信息，内容为BoxInfo
+	EventInfo = "info"
+	//EventHostKeyMismatch ssh服务端主机密钥不一致，拒绝打开终端，内容为HostKeyMismatch
+	EventHostKeyMismatch = "ssh.hostkey.mismatch"
+)
+
+//事件级别
+const (
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+//错误代码
+const (
+	//CodeFailed 处理失败
+	CodeFailed = "9999"
+	//CodeUnsupported 不支持的方法或版本
+	CodeUnsupported = "9001"
+	//CodeBadRequest 报文格式错误
+	CodeBadRequest = "9002"
+	//CodeHostKey ssh服务端主机密钥校验失败
+	CodeHostKey = "9003"
+	//CodeVerify 更新文件校验失败
+	CodeVerify = "9004"
+)
+
+//LegacyCodes 旧版本协议使用1字节表示方法
+//旧版本box不进行握手，云端只能使用这些方法
+var LegacyCodes = map[string]byte{
+	MethodPullConfig: 2,
+	MethodPtyReq:     3,
+	MethodUpdate:     4,
+}
+
+//Message 控制通道上传输的报文
+type Message struct {
+	//协议版本
+	Version int
+	//报文类型
+	Type string
+	//消息ID，返回报文将带回请求的ID
+	ID uint32
+	//方法名称
+	Method string `json:",omitempty"`
+	//报文内容，由方法决定具体格式
+	Body json.RawMessage `json:",omitempty"`
+	//处理出错时返回
+	Error *Error `json:",omitempty"`
+}
+
+//Error 返回报文中的错误信息
+type Error struct {
+	Code string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("[%s]%s", e.Code, e.Msg)
+}
+
+//NewError ...
+func NewError(code, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+//Hello 握手报文，box上报支持的协议版本和方法
+//云端返回协商后的版本和双方都支持的方法
+type Hello struct {
+	Version int
+	Methods []string
+	//box的设备信息，只在box发送的握手报文中
+	Info *BoxInfo `json:",omitempty"`
+}
+
+//BoxInfo box的设备信息，连接时和定时上报
+type BoxInfo struct {
+	//程序版本
+	Version string
+	GOOS    string
+	GOARCH  string
+	//主机名和内核版本
+	Hostname string
+	Kernel   string
+	//开机时长，单位秒
+	Uptime int64
+	//本地IP地址
+	IPs []string
+	//配置文件的MD5
+	ConfigMD5 string
+	//采集时间
+	Time time.Time
+}
+
+//PtyReq 建立终端请求
+type PtyReq struct {
+	Addr     string
+	User     string
+	Password string
+	//ssh服务端主机密钥指纹，格式为 SHA256:base64
+	HostKey string `json:",omitempty"`
+	//终端会话ID，每个会话单独建立连接和伪终端，旧版本服务端不发送
+	Session string `json:",omitempty"`
+	//终端空闲超时和最长时长，单位秒，为0时使用box本地配置
+	IdleTimeout int `json:",omitempty"`
+	MaxDuration int `json:",omitempty"`
+}
+
+//HostKeyMismatch 主机密钥不一致事件的内容
+type HostKeyMismatch struct {
+	Addr     string
+	Expected []string
+	Actual   string
+}
+
+//执行命令的限制
+const (
+	//ExecTimeout 默认超时时间，单位秒
+	ExecTimeout = 30
+	//ExecMaxTimeout 最长超时时间，单位秒
+	ExecMaxTimeout = 10 * 60
+	//ExecMaxOutput stdout和stderr分别保留的最大字节数，超出部分丢弃
+	ExecMaxOutput = 64 * 1024
+	//ExecWaitDelay 命令退出后等待输出的最长时间，后台子进程占用输出时不会一直等待
+	ExecWaitDelay = 5 * time.Second
+)
+
+//ExecEncodingBase64 输出不是有效的UTF-8时使用base64编码
+const ExecEncodingBase64 = "base64"
+
+//ExecReq 在box上执行命令的请求，命令使用系统shell执行
+type ExecReq struct {
+	Command string
+	//工作目录，为空时使用box程序的工作目录
+	Dir string `json:",omitempty"`
+	//附加的环境变量，格式为 KEY=VALUE
+	Env []string `json:",omitempty"`
+	//超时时间，单位秒，为0时使用ExecTimeout，超时后结束命令
+	Timeout int `json:",omitempty"`
+}
+
+//TimeoutDuration 返回命令的超时时间，不超过ExecMaxTimeout
+func (r *ExecReq) TimeoutDuration() time.Duration {
+	t := r.Timeout
+	if t <= 0 {
+		t = ExecTimeout
+	}
+	if t > ExecMaxTimeout {
+		t = ExecMaxTimeout
+	}
+	return time.Duration(t) * time.Second
+}
+
+//ExecRes 命令的执行结果
+type ExecRes struct {
+	//退出码，命令被结束时为-1
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	//输出的编码，为空时是原始文本，为ExecEncodingBase64时需要解码
+	StdoutEncoding string `json:",omitempty"`
+	StderrEncoding string `json:",omitempty"`
+	//输出超过ExecMaxOutput被截断
+	StdoutTruncated bool `json:",omitempty"`
+	StderrTruncated bool `json:",omitempty"`
+	//是否因超时被结束
+	TimedOut bool `json:",omitempty"`
+	//执行时长，单位毫秒
+	Duration int64
+}
+
+//UpdateReq 更新程序请求
+type UpdateReq struct {
+	Version string
+}
+
+//Event 事件内容
+type Event struct {
+	//事件发生时间
+	Time time.Time
+	//事件级别
+	Level string
+	//事件描述
+	Msg string
+	//附加数据，由事件决定具体格式
+	Data json.RawMessage `json:",omitempty"`
+}
+
+//NewMessage 生成报文，body将被编码为json
+func NewMessage(typ string, id uint32, method string, body interface{}) (msg *Message, err error) {
+	msg = &Message{Version: Version, Type: typ, ID: id, Method: method}
+	if body != nil {
+		if msg.Body, err = json.Marshal(body); err != nil {
+			err = fmt.Errorf("json 打包出错 %v", err)
+			return
+		}
+	}
+	return
+}
+
+//NewResponse 根据请求生成返回报文，err不为空时将带上错误信息
+func NewResponse(req *Message, body interface{}, err error) (msg *Message, e error) {
+	if msg, e = NewMessage(TypeResponse, req.ID, req.Method, body); e != nil {
+		return
+	}
+	if err != nil {
+		if v, ok := err.(*Error); ok {
+			msg.Error = v
+		} else {
+			msg.Error = &Error{Code: CodeFailed, Msg: err.Error()}
+		}
+	}
+	return
+}
+
+//Decode 将报文内容解析到v
+func (m *Message) Decode(v interface{}) (err error) {
+	if len(m.Body) == 0 {
+		return nil
+	}
+	if err = json.Unmarshal(m.Body, v); err != nil {
+		err = fmt.Errorf("json 解析出错 %v", err)
+	}
+	return
+}
+
+//Marshal 将报文编码
+func Marshal(m *Message) (buff []byte, err error) {
+	if buff, err = json.Marshal(m); err != nil {
+		err = fmt.Errorf("json 打包出错 %v", err)
+	}
+	return
+}
+
+//Unmarshal 解析报文
+func Unmarshal(buff []byte) (m *Message, err error) {
+	m = new(Message)
+	if err = json.Unmarshal(buff, m); err != nil {
+		err = fmt.Errorf("json 解析出错 %v", err)
+		return
+	}
+	if m.Type == "" {
+		err = fmt.Errorf("报文缺少类型")
+	}
+	return
+}
+
+//Supported 判断methods中是否包含method
+func Supported(methods []string, method string) bool {
+	for _, v := range methods {
+		if v == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+)
+
+//Release 发布文件的签名信息
+//签名使用离线保存的ed25519私钥，box使用内置的公钥校验
+type Release struct {
+	GOOS    string
+	GOARCH  string
+	Version string
+	//文件的SHA-256，hex格式
+	SHA256 string
+	//签名，base64格式
+	Signature string
+}
+
+//SignedData 签名的内容，包含平台和版本，防止签名被用于其他文件
+func (r *Release) SignedData() []byte {
+	return []byte(fmt.Sprintf("box-release\n%s\n%s\n%s\n%s\n", r.GOOS, r.GOARCH, r.Version, r.SHA256))
+}
+
+//Sign 使用私钥签名
+func (r *Release) Sign(key ed25519.PrivateKey) {
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, r.SignedData()))
+}
+
+//Verify 使用公钥校验签名
+func (r *Release) Verify(key ed25519.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return fmt.Errorf("签名格式错误 %v", err)
+	}
+	if !ed25519.Verify(key, r.SignedData(), sig) {
+		return fmt.Errorf("签名校验失败")
+	}
+	return nil
+}
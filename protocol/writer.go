@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	//BulkSize 超过此长度的报文使用低优先级发送
+	BulkSize = 4096
+	//写入超时时间
+	writeWait = 10 * time.Second
+)
+
+type frame struct {
+	typ  int
+	data []byte
+}
+
+//Writer websocket连接的发送队列
+//websocket不支持并发写，所有写入都由一个goroutine完成，
+//控制帧和小报文优先发送，队列满时直接返回错误，不会阻塞调用者
+type Writer struct {
+	conn *websocket.Conn
+	//控制帧和小报文
+	high chan frame
+	//大报文
+	low  chan frame
+	done chan struct{}
+	once *sync.Once
+}
+
+//NewWriter 启动发送goroutine，size为每个队列的长度
+func NewWriter(conn *websocket.Conn, size int) *Writer {
+	w := new(Writer)
+	w.conn = conn
+	w.high = make(chan frame, size)
+	w.low = make(chan frame, size)
+	w.done = make(chan struct{})
+	w.once = new(sync.Once)
+	go w.loop()
+	return w
+}
+
+//WriteMessage 报文加入发送队列
+func (w *Writer) WriteMessage(typ int, data []byte) error {
+	if len(data) > BulkSize {
+		return w.push(w.low, frame{typ, data})
+	}
+	return w.push(w.high, frame{typ, data})
+}
+
+//WriteControl 控制帧加入发送队列，优先发送
+func (w *Writer) WriteControl(typ int, data []byte) error {
+	return w.push(w.high, frame{typ, data})
+}
+
+func (w *Writer) push(ch chan frame, f frame) (err error) {
+	select {
+	case <-w.done:
+		return fmt.Errorf("连接已关闭")
+	default:
+	}
+	select {
+	case ch <- f:
+	default:
+		err = fmt.Errorf("发送队列已满")
+	}
+	return
+}
+
+//Close 停止发送，未发送的报文将丢弃
+func (w *Writer) Close() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+//Done 发送停止后关闭
+func (w *Writer) Done() <-chan struct{} {
+	return w.done
+}
+
+//写入出错时关闭连接，读取方将收到错误
+func (w *Writer) loop() {
+	for {
+		var f frame
+		select {
+		case f = <-w.high:
+		default:
+			select {
+			case f = <-w.high:
+			case f = <-w.low:
+			case <-w.done:
+				return
+			}
+		}
+		if err := w.write(f); err != nil {
+			w.Close()
+			w.conn.Close()
+			return
+		}
+	}
+}
+
+func (w *Writer) write(f frame) error {
+	deadline := time.Now().Add(writeWait)
+	switch f.typ {
+	case websocket.PingMessage, websocket.PongMessage, websocket.CloseMessage:
+		return w.conn.WriteControl(f.typ, f.data, deadline)
+	default:
+		w.conn.SetWriteDeadline(deadline)
+		return w.conn.WriteMessage(f.typ, f.data)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//审计结果
+const (
+	AuditSuccess = "success"
+	AuditFailed  = "failed"
+	//任务已开始或已加入离线队列，结果通过任务查询
+	AuditStarted = "started"
+	AuditDenied  = "denied"
+)
+
+//auditEntry 每个操作记录一条
+type auditEntry struct {
+	Time     time.Time
+	Operator string
+	//操作员的IP
+	Addr string
+	//操作名称，如 method.update upload terminal.open
+	Action  string
+	EndSn   string `json:",omitempty"`
+	Account string `json:",omitempty"`
+	//操作的附加信息，如任务ID
+	Detail string `json:",omitempty"`
+	Result string
+	Error  string `json:",omitempty"`
+}
+
+//auditQuery 查询条件，为空的条件不过滤
+type auditQuery struct {
+	EndSn    string
+	Operator string
+	From     time.Time
+	To       time.Time
+	//最多返回的条数，按时间倒序
+	Limit int
+}
+
+func (q *auditQuery) match(e *auditEntry) bool {
+	if q.EndSn != "" && e.EndSn != q.EndSn {
+		return false
+	}
+	if q.Operator != "" && e.Operator != q.Operator {
+		return false
+	}
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && e.Time.After(q.To) {
+		return false
+	}
+	return true
+}
+
+//auditLog 审计日志，每条记录为一行json，只追加不修改
+type auditLog struct {
+	mu         *sync.Mutex
+	filename   string
+	file       *os.File
+	contextLog *logrus.Entry
+}
+
+func newAuditLog(filename string) *auditLog {
+	a := new(auditLog)
+	a.mu = new(sync.Mutex)
+	a.filename = filename
+	a.contextLog = logrus.WithField("module", "audit")
+	return a
+}
+
+//Open 以追加方式打开审计日志
+func (a *auditLog) Open() (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err = os.MkdirAll(filepath.Dir(a.filename), 0755); err != nil {
+		err = fmt.Errorf("建立文件夹出错 %v", err)
+		return
+	}
+	if a.file, err = os.OpenFile(a.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640); err != nil {
+		err = fmt.Errorf("打开审计日志出错 %v", err)
+	}
+	return
+}
+
+//Append 写入一条记录，写入失败只记录日志
+func (a *auditLog) Append(e *auditEntry) {
+	buff, err := json.Marshal(e)
+	if err != nil {
+		a.contextLog.WithField("msg", "json 打包").Errorln(err)
+		return
+	}
+	buff = append(buff, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		a.contextLog.WithField("action", e.Action).Errorln("审计日志未打开")
+		return
+	}
+	if _, err = a.file.Write(buff); err != nil {
+		a.contextLog.WithField("msg", "写入审计日志").Errorln(err)
+	}
+}
+
+//Query 按时间倒序返回符合条件的记录
+func (a *auditLog) Query(q *auditQuery, filter func(e *auditEntry) bool) (entries []*auditEntry, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	file, err := os.Open(a.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		err = fmt.Errorf("打开审计日志出错 %v", err)
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := new(auditEntry)
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			continue
+		}
+		if !q.match(e) || !filter(e) {
+			continue
+		}
+		entries = append(entries, e)
+		//只保留最新的Limit条
+		if q.Limit > 0 && len(entries) > 2*q.Limit {
+			entries = append(entries[:0:0], entries[len(entries)-q.Limit:]...)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("读取审计日志出错 %v", err)
+		return
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return
+}
+
+//记录网页操作，err不为空时结果为失败
+func (s *Server) record(r *http.Request, action, endsn, detail, result string, err error) {
+	e := &auditEntry{Time: time.Now(), Action: action, EndSn: endsn, Detail: detail, Result: result}
+	if op := operatorFrom(r); op != nil {
+		e.Operator = op.Name
+	}
+	e.Addr, _, _ = net.SplitHostPort(r.RemoteAddr)
+	if endsn != "" {
+		e.Account, _ = s.boxs.Account(endsn)
+	}
+	if err != nil {
+		e.Error = err.Error()
+		if result == AuditSuccess {
+			e.Result = AuditFailed
+		}
+	}
+	s.audit.Append(e)
+}
+
+//审计结果，err不为空时为失败
+func auditResult(err error) string {
+	if err != nil {
+		return AuditFailed
+	}
+	return AuditSuccess
+}
+
+//解析查询条件，时间格式为 2006-01-02 15:04:05
+func parseAuditQuery(r *http.Request) (q *auditQuery, err error) {
+	q = &auditQuery{EndSn: r.FormValue("endsn"), Operator: r.FormValue("operator"), Limit: 500}
+	if v := r.FormValue("from"); v != "" {
+		if q.From, err = time.ParseInLocation("2006-01-02 15:04:05", v, time.Local); err != nil {
+			err = fmt.Errorf("开始时间格式错误 %v", err)
+			return
+		}
+	}
+	if v := r.FormValue("to"); v != "" {
+		if q.To, err = time.ParseInLocation("2006-01-02 15:04:05", v, time.Local); err != nil {
+			err = fmt.Errorf("结束时间格式错误 %v", err)
+			return
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			err = fmt.Errorf("limit格式错误 %v", err)
+			return
+		}
+	}
+	return
+}
+
+//查询审计日志，只返回操作员可以访问的账号的记录
+func (s *Server) queryAudit(r *http.Request) ([]*auditEntry, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	q, err := parseAuditQuery(r)
+	if err != nil {
+		return nil, err
+	}
+	op := operatorFrom(r)
+	return s.audit.Query(q, func(e *auditEntry) bool {
+		return op.CanAccess(e.Account)
+	})
+}
+
+//审计日志接口
+//参数 endsn operator from to limit，时间格式为 2006-01-02 15:04:05
+func (s *Server) auditList(w http.ResponseWriter, r *http.Request) {
+	contextLog := s.contextLog.WithField("func", "查询审计日志")
+	entries, err := s.queryAudit(r)
+	if err != nil {
+		contextLog.Errorln(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if entries == nil {
+		entries = []*auditEntry{}
+	}
+	buff, err := json.Marshal(entries)
+	if err != nil {
+		contextLog.WithField("msg", "json 打包").Errorln(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buff)
+}
+
+//审计日志网页
+func (s *Server) auditPage(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.queryAudit(r)
+	var trs []string
+	if err != nil {
+		trs = append(trs, fmt.Sprintf(`<tr class="am-danger"><td colspan="8">%s</td></tr>`, html.EscapeString(err.Error())))
+	}
+	for _, e := range entries {
+		trs = append(trs, genAuditTr(e))
+	}
+	w.Write([]byte(genAuditPage(r, trs)))
+}
+
+func genAuditTr(e *auditEntry) string {
+	var class string
+	switch e.Result {
+	case AuditFailed:
+		class = "am-warning"
+	case AuditDenied:
+		class = "am-danger"
+	}
+	return fmt.Sprintf(`<tr class="%s">
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+    </tr>`, class, e.Time.Format("2006-01-02 15:04:05"), html.EscapeString(e.Operator), e.Addr,
+		html.EscapeString(e.Action), html.EscapeString(e.EndSn), html.EscapeString(e.Detail), e.Result, html.EscapeString(e.Error))
+}
+
+func genAuditPage(r *http.Request, trs []string) string {
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>审计日志</title>
+    <link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/amazeui/2.7.2/css/amazeui.min.css"/>
+</head>
+<body>
+<form class="am-form-inline" method="GET" action="/auditPage">
+    <input type="text" class="am-form-field" name="endsn" placeholder="Endsn" value="%s">
+    <input type="text" class="am-form-field" name="operator" placeholder="操作员" value="%s">
+    <input type="text" class="am-form-field" name="from" placeholder="开始 2006-01-02 15:04:05" value="%s">
+    <input type="text" class="am-form-field" name="to" placeholder="结束 2006-01-02 15:04:05" value="%s">
+    <button type="submit" class="am-btn am-btn-primary">查询</button>
+    <a href="/">返回</a>
+</form>
+<table class="am-table am-table-bordered am-table-radius am-table-compact am-text-nowrap">
+    <thead>
+    <tr>
+        <th>时间</th>
+        <th>操作员</th>
+        <th>IP</th>
+        <th>操作</th>
+        <th>Endsn</th>
+        <th>详情</th>
+        <th>结果</th>
+        <th>错误</th>
+    </tr>
+    </thead>
+    <tbody>
+    %s
+    </tbody>
+</table>
+</body>
+</html>`, html.EscapeString(r.FormValue("endsn")), html.EscapeString(r.FormValue("operator")),
+		html.EscapeString(r.FormValue("from")), html.EscapeString(r.FormValue("to")), strings.Join(trs, "\n"))
+}
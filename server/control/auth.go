@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//box认证方式
+const (
+	AuthNone  = "none"
+	AuthSSO   = "sso"
+	AuthToken = "token"
+	AuthHMAC  = "hmac"
+)
+
+//挑战码有效时间
+const challengeExpire = time.Minute
+
+//authenticator 校验box的身份，box使用cookie提交认证信息
+type authenticator interface {
+	//Authenticate 校验请求是否来自endsn
+	Authenticate(r *http.Request, endsn string) error
+}
+
+//challenger 需要先获取挑战码的认证方式
+type challenger interface {
+	Challenge(endsn string) (nonce string, err error)
+}
+
+//根据配置生成认证方式
+func newAuthenticator(cfg AuthConfig) (authenticator, error) {
+	switch cfg.Mode {
+	case AuthNone:
+		return noneAuth{}, nil
+	case AuthSSO:
+		return &ssoAuth{url: cfg.SSOURL, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case AuthToken:
+		store, err := loadTokenStore(cfg.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tokenAuth{store: store}, nil
+	case AuthHMAC:
+		store, err := loadTokenStore(cfg.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return newHMACAuth(store)
+	default:
+		return nil, fmt.Errorf("不支持的认证方式 %s", cfg.Mode)
+	}
+}
+
+//获取cookie的值，不存在时为空
+func cookieValue(r *http.Request, name string) string {
+	v, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return v.Value
+}
+
+//noneAuth 不认证
+type noneAuth struct{}
+
+func (noneAuth) Authenticate(r *http.Request, endsn string) error {
+	return nil
+}
+
+type reqToken struct {
+	Account   string `comment:"登录账号"`
+	EpeToken  string `comment:"登录令牌"`
+	EpeVerify string `comment:"登录校验"`
+	EndType   string `comment:"终端类型"`
+	EndCode   string `comment:"终端编号"`
+}
+
+type resToken struct {
+	ErrorNo  string `comment:"错误号"`
+	ErrorMsg string `comment:"错误信息"`
+}
+
+//ssoAuth 使用单点登录服务校验account,token,verify
+type ssoAuth struct {
+	url    string
+	client *http.Client
+}
+
+func (a *ssoAuth) Authenticate(r *http.Request, endsn string) (err error) {
+	req := new(reqToken)
+	req.Account = cookieValue(r, "account")
+	req.EpeToken = cookieValue(r, "token")
+	req.EpeVerify = cookieValue(r, "verify")
+	req.EndCode = endsn
+	if req.Account == "" || req.EpeToken == "" {
+		err = fmt.Errorf("未提供账号或令牌")
+		return
+	}
+	buff, err := json.Marshal(req)
+	if err != nil {
+		err = fmt.Errorf("json 打包错误 %v", err)
+		return
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(buff))
+	if err != nil {
+		err = fmt.Errorf("POST %s 出错 %v", a.url, err)
+		return
+	}
+	defer resp.Body.Close()
+	buff, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("读取r.Bdoy 出错 %v", err)
+		return
+	}
+	res := new(resToken)
+	if err = json.Unmarshal(buff, res); err != nil {
+		err = fmt.Errorf("json 解析出错 %v", err)
+		return
+	}
+	if res.ErrorNo != "0000" {
+		err = fmt.Errorf("服务器返回错误[%s]", res.ErrorMsg)
+	}
+	return
+}
+
+//tokenEntry box的令牌和绑定的账号
+type tokenEntry struct {
+	Token string
+	//box连接时提交的账号必须与此一致，为空时不检查
+	Account string
+}
+
+//UnmarshalJSON 兼容只保存令牌的旧格式 {"endsn":"令牌"}
+func (e *tokenEntry) UnmarshalJSON(buff []byte) error {
+	if len(buff) > 0 && buff[0] == '"' {
+		return json.Unmarshal(buff, &e.Token)
+	}
+	type entry tokenEntry
+	return json.Unmarshal(buff, (*entry)(e))
+}
+
+//tokenStore 本地保存的box令牌，主键为endsn
+type tokenStore map[string]*tokenEntry
+
+//令牌文件为json对象 {"endsn":"令牌"} 或 {"endsn":{"Token":"令牌","Account":"账号"}}
+func loadTokenStore(filename string) (store tokenStore, err error) {
+	if filename == "" {
+		err = fmt.Errorf("未配置令牌文件")
+		return
+	}
+	buff, err := ioutil.ReadFile(filename)
+	if err != nil {
+		err = fmt.Errorf("读取令牌文件出错 %v", err)
+		return
+	}
+	if err = json.Unmarshal(buff, &store); err != nil {
+		err = fmt.Errorf("解析令牌文件出错 %v", err)
+	}
+	return
+}
+
+//查找endsn的令牌，并检查box提交的账号与绑定的账号一致
+func (t tokenStore) lookup(r *http.Request, endsn string) (secret string, err error) {
+	e, ok := t[endsn]
+	if !ok || e == nil || e.Token == "" {
+		return "", fmt.Errorf("endsn %s 没有配置令牌", endsn)
+	}
+	if e.Account != "" && cookieValue(r, "account") != e.Account {
+		return "", fmt.Errorf("endsn %s 的账号不一致", endsn)
+	}
+	return e.Token, nil
+}
+
+//tokenAuth 校验box提交的令牌与本地保存的令牌一致
+type tokenAuth struct {
+	store tokenStore
+}
+
+func (a *tokenAuth) Authenticate(r *http.Request, endsn string) error {
+	expect, err := a.store.lookup(r, endsn)
+	if err != nil {
+		return err
+	}
+	token := cookieValue(r, "token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expect)) != 1 {
+		return fmt.Errorf("令牌错误")
+	}
+	return nil
+}
+
+//hmacAuth 挑战应答认证，令牌不在网络上传输
+//box先获取挑战码，再提交 HMAC-SHA256(令牌, endsn + "." + 账号 + "." + 挑战码)
+//挑战码由云端签名，不需要保存，任何人获取挑战码都不会占用云端资源
+//认证成功后挑战码在有效期内记为已使用，每个挑战码只能使用一次
+type hmacAuth struct {
+	store tokenStore
+	//挑战码的签名密钥，启动时随机生成
+	key  []byte
+	mu   *sync.Mutex
+	used map[string]time.Time
+}
+
+func newHMACAuth(store tokenStore) (*hmacAuth, error) {
+	a := new(hmacAuth)
+	a.store = store
+	a.key = make([]byte, 32)
+	if _, err := rand.Read(a.key); err != nil {
+		return nil, fmt.Errorf("生成挑战码密钥出错 %v", err)
+	}
+	a.mu = new(sync.Mutex)
+	a.used = make(map[string]time.Time)
+	return a, nil
+}
+
+//挑战码签名，包含endsn，不能用于其它box
+func (a *hmacAuth) sign(endsn, stamp, random string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(endsn + "." + stamp + "." + random))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Challenge 生成挑战码，格式为 时间戳-随机数-签名
+//没有配置令牌的endsn也会返回挑战码，避免泄露哪些endsn存在
+func (a *hmacAuth) Challenge(endsn string) (nonce string, err error) {
+	buff := make([]byte, 16)
+	if _, err = rand.Read(buff); err != nil {
+		err = fmt.Errorf("生成挑战码出错 %v", err)
+		return
+	}
+	stamp := strconv.FormatInt(time.Now().Unix(), 16)
+	random := hex.EncodeToString(buff)
+	return stamp + "-" + random + "-" + a.sign(endsn, stamp, random), nil
+}
+
+//校验挑战码是云端为endsn生成的，并且没有过期
+func (a *hmacAuth) verifyNonce(endsn, nonce string) (expire time.Time, err error) {
+	parts := strings.Split(nonce, "-")
+	if len(parts) != 3 {
+		err = fmt.Errorf("挑战码格式错误")
+		return
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(a.sign(endsn, parts[0], parts[1]))) {
+		err = fmt.Errorf("挑战码无效")
+		return
+	}
+	stamp, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		err = fmt.Errorf("挑战码格式错误")
+		return
+	}
+	expire = time.Unix(stamp, 0).Add(challengeExpire)
+	if time.Now().After(expire) {
+		err = fmt.Errorf("挑战码已过期")
+	}
+	return
+}
+
+func (a *hmacAuth) Authenticate(r *http.Request, endsn string) error {
+	nonce := cookieValue(r, "nonce")
+	expire, err := a.verifyNonce(endsn, nonce)
+	if err != nil {
+		return err
+	}
+	secret, err := a.store.lookup(r, endsn)
+	if err != nil {
+		return err
+	}
+	signature, err := hex.DecodeString(cookieValue(r, "signature"))
+	if err != nil {
+		return fmt.Errorf("签名格式错误")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(endsn + "." + cookieValue(r, "account") + "." + nonce))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return fmt.Errorf("签名错误")
+	}
+	//只有签名正确的挑战码才会记录，数量受box的请求频率限制
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, t := range a.used {
+		if now.After(t) {
+			delete(a.used, k)
+		}
+	}
+	if _, ok := a.used[nonce]; ok {
+		return fmt.Errorf("挑战码已经使用")
+	}
+	a.used[nonce] = expire
+	return nil
+}
+
+//box获取挑战码，只有hmac认证时可用
+func (s *Server) challenge(w http.ResponseWriter, r *http.Request) {
+	contextLog := s.contextLog.WithField("func", "获取挑战码")
+	c, ok := s.auth.(challenger)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var res struct {
+		Code  string
+		Msg   string
+		Nonce string
+	}
+	res.Code = "0000"
+	endsn := r.FormValue("endsn")
+	nonce, err := c.Challenge(endsn)
+	if err != nil {
+		contextLog.WithField("endsn", endsn).Errorln(err)
+		res.Code = "9999"
+		res.Msg = err.Error()
+	}
+	res.Nonce = nonce
+	buff, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buff)
+}
+
+//校验box证书和身份
+func (s *Server) authenticate(r *http.Request, endsn string) error {
+	if endsn == "" {
+		return fmt.Errorf("未提供endsn")
+	}
+	if err := s.verifyCert(r, endsn); err != nil {
+		return err
+	}
+	return s.auth.Authenticate(r, endsn)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+//Config 云端配置，使用json格式保存
+//配置文件不存在时使用默认配置
+type Config struct {
+	//事件将POST到这些地址
+	Webhooks []WebhookConfig
+	//box离线超过此时长将产生事件，单位分钟，0为不检查
+	OfflineAlarm int
+	//运行数据保存目录
+	DataDir string
+	//离线任务默认过期时间，单位秒
+	QueueExpire int
+	//https和wss证书配置
+	TLS TLSConfig
+	//box认证配置
+	Auth AuthConfig
+	//连续登录失败达到此次数后锁定，ssh和网页分别统计，必须大于0
+	LoginMaxFailures int
+	//锁定时长，单位分钟，必须大于0
+	//在DataDir下建立unlock文件可以解除全部锁定
+	LoginLockout int
+	//终端空闲超时，超过此时间没有输入将断开，单位分钟，为0时不限制
+	TerminalIdle int
+	//终端最长打开时间，单位分钟，为0时不限制
+	TerminalMax int
+}
+
+//AuthConfig box认证配置
+type AuthConfig struct {
+	//认证方式 sso token hmac none，默认为sso
+	Mode string
+	//单点登录校验地址，sso认证使用
+	SSOURL string
+	//本地令牌文件，token和hmac认证使用，内容为 {"endsn":"令牌"}
+	//或 {"endsn":{"Token":"令牌","Account":"账号"}}，配置账号后box提交的账号必须一致
+	TokenFile string
+}
+
+//WebhookConfig 事件推送配置
+type WebhookConfig struct {
+	URL string
+	//签名密钥，为空时不签名
+	Secret string
+	//只推送这些事件，为空时推送全部
+	Events []string
+	//推送失败后的最大重试次数，为0时重试5次
+	Retries int
+}
+
+func defaultConfig() *Config {
+	cfg := new(Config)
+	cfg.DataDir = "./data"
+	cfg.QueueExpire = 24 * 60 * 60
+	cfg.LoginMaxFailures = 10
+	cfg.LoginLockout = 15
+	cfg.TerminalIdle = 15
+	cfg.TerminalMax = 4 * 60
+	cfg.Auth.Mode = AuthSSO
+	cfg.Auth.SSOURL = "http://www.yireyun.com/sso/verifyEpe"
+	return cfg
+}
+
+//LoadConfig 读取配置文件
+func LoadConfig(filename string) (cfg *Config, err error) {
+	cfg = defaultConfig()
+	buff, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		err = fmt.Errorf("读取配置文件出错 %v", err)
+		return
+	}
+	if err = json.Unmarshal(buff, cfg); err != nil {
+		err = fmt.Errorf("解析配置文件出错 %v", err)
+		return
+	}
+	err = cfg.validate()
+	return
+}
+
+//检查配置的取值范围
+func (cfg *Config) validate() (err error) {
+	if cfg.LoginMaxFailures < 1 {
+		return fmt.Errorf("配置错误 LoginMaxFailures 必须大于0,当前为%d", cfg.LoginMaxFailures)
+	}
+	if cfg.LoginLockout < 1 {
+		return fmt.Errorf("配置错误 LoginLockout 必须大于0,当前为%d", cfg.LoginLockout)
+	}
+	return
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"easy/control/protocol"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//box在线状态变化时云端产生的事件
+const (
+	EventBoxOnline   = "box.online"
+	EventBoxOffline  = "box.offline"
+	EventBoxReplaced = "box.replaced"
+	//离线超过配置的时长
+	EventBoxOfflineLong = "box.offline.long"
+)
+
+//presenceData 在线状态事件的附加数据
+type presenceData struct {
+	RemoteAddr string
+	Reason     string `json:",omitempty"`
+	Reconnects int
+	//已经离线的分钟数
+	OfflineMinutes int `json:",omitempty"`
+}
+
+//newPresenceEvent 根据连接记录生成在线状态事件
+func newPresenceEvent(name, level, msg string, rec *boxRecord) *boxEvent {
+	ev := &boxEvent{EndSn: rec.EndSn, Account: rec.Account, Name: name}
+	ev.Time = time.Now()
+	ev.Level = level
+	ev.Msg = msg
+	data := &presenceData{RemoteAddr: rec.RemoteAddr, Reconnects: rec.Reconnects}
+	if !rec.Online {
+		data.Reason = rec.DisconnectReason
+		data.OfflineMinutes = int(time.Since(rec.LastDisconnect) / time.Minute)
+	}
+	ev.Data, _ = json.Marshal(data)
+	return ev
+}
+
+//validLevel 是否为协议定义的事件级别
+func validLevel(level string) bool {
+	switch level {
+	case protocol.LevelInfo, protocol.LevelWarn, protocol.LevelError:
+		return true
+	}
+	return false
+}
+
+//boxEvent box上报的事件
+type boxEvent struct {
+	EndSn   string
+	Account string
+	Name    string
+	protocol.Event
+}
+
+//eventHandler 事件订阅者，Handle不能阻塞
+type eventHandler interface {
+	Handle(ev *boxEvent)
+}
+
+//eventBus 将box上报的事件分发给所有订阅者
+type eventBus struct {
+	mu       *sync.RWMutex
+	handlers []eventHandler
+}
+
+func newEventBus() *eventBus {
+	e := new(eventBus)
+	e.mu = new(sync.RWMutex)
+	return e
+}
+
+//Subscribe 添加订阅者
+func (e *eventBus) Subscribe(h eventHandler) {
+	e.mu.Lock()
+	e.handlers = append(e.handlers, h)
+	e.mu.Unlock()
+}
+
+//Publish 分发事件
+func (e *eventBus) Publish(ev *boxEvent) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, h := range e.handlers {
+		h.Handle(ev)
+	}
+}
+
+//logHandler 将事件写入日志
+type logHandler struct {
+	contextLog *logrus.Entry
+}
+
+func newLogHandler() *logHandler {
+	h := new(logHandler)
+	h.contextLog = logrus.WithField("module", "event")
+	return h
+}
+
+func (h *logHandler) Handle(ev *boxEvent) {
+	contextLog := h.contextLog.WithFields(logrus.Fields{"endsn": ev.EndSn, "account": ev.Account, "event": ev.Name})
+	switch ev.Level {
+	case protocol.LevelError:
+		contextLog.Errorln(ev.Msg)
+	case protocol.LevelWarn:
+		contextLog.Warnln(ev.Msg)
+	default:
+		contextLog.Infoln(ev.Msg)
+	}
+}
+
+//recentEvents 保存最近的事件，供网页显示
+type recentEvents struct {
+	mu     *sync.Mutex
+	size   int
+	events []*boxEvent
+}
+
+func newRecentEvents(size int) *recentEvents {
+	r := new(recentEvents)
+	r.mu = new(sync.Mutex)
+	r.size = size
+	return r
+}
+
+func (r *recentEvents) Handle(ev *boxEvent) {
+	r.mu.Lock()
+	r.events = append(r.events, ev)
+	if len(r.events) > r.size {
+		r.events = r.events[len(r.events)-r.size:]
+	}
+	r.mu.Unlock()
+}
+
+//List 按时间倒序返回事件，endsn为空时返回全部
+func (r *recentEvents) List(endsn string) (events []*boxEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if endsn == "" || r.events[i].EndSn == endsn {
+			events = append(events, r.events[i])
+		}
+	}
+	return
+}
+
+//每个推送地址最多缓存的事件数，超过后新的事件将被丢弃
+const webhookQueueSize = 100
+
+//webhookHandler 将事件以json格式POST到配置的地址
+//配置了密钥时使用HMAC-SHA256签名，推送失败将按指数退避重试
+//每个地址使用一个队列按顺序推送，推送慢的地址不影响其它地址
+type webhookHandler struct {
+	hooks      []*webhookQueue
+	client     *http.Client
+	contextLog *logrus.Entry
+}
+
+//一个推送地址的事件队列
+type webhookQueue struct {
+	WebhookConfig
+	queue chan *webhookMsg
+}
+
+type webhookMsg struct {
+	name string
+	buff []byte
+}
+
+func newWebhookHandler(hooks []WebhookConfig) *webhookHandler {
+	h := new(webhookHandler)
+	h.client = new(http.Client)
+	h.client.Timeout = 5 * time.Second
+	h.contextLog = logrus.WithField("module", "webhook")
+	for _, hook := range hooks {
+		if hook.Retries == 0 {
+			hook.Retries = 5
+		}
+		q := &webhookQueue{WebhookConfig: hook, queue: make(chan *webhookMsg, webhookQueueSize)}
+		h.hooks = append(h.hooks, q)
+		go h.run(q)
+	}
+	return h
+}
+
+//Handle 将事件放入各个地址的队列，不等待推送完成
+func (h *webhookHandler) Handle(ev *boxEvent) {
+	buff, err := json.Marshal(ev)
+	if err != nil {
+		h.contextLog.WithField("msg", "json 打包").Errorln(err)
+		return
+	}
+	for _, q := range h.hooks {
+		if len(q.Events) > 0 && !protocol.Supported(q.Events, ev.Name) {
+			continue
+		}
+		select {
+		case q.queue <- &webhookMsg{name: ev.Name, buff: buff}:
+		default:
+			h.contextLog.WithFields(logrus.Fields{"url": q.URL, "event": ev.Name}).Warnln("推送队列已满,丢弃事件")
+		}
+	}
+}
+
+//按顺序推送队列中的事件
+func (h *webhookHandler) run(q *webhookQueue) {
+	for msg := range q.queue {
+		h.deliver(q.WebhookConfig, msg.name, msg.buff)
+	}
+}
+
+//推送事件，失败后等待1s,2s,4s...重试，最长等待5分钟
+func (h *webhookHandler) deliver(hook WebhookConfig, name string, buff []byte) {
+	contextLog := h.contextLog.WithFields(logrus.Fields{"url": hook.URL, "event": name})
+	var delay time.Duration
+	for i := 0; ; i++ {
+		err := h.post(hook, name, buff)
+		if err == nil {
+			return
+		}
+		if i >= hook.Retries {
+			contextLog.WithField("msg", "推送失败,放弃重试").Errorln(err)
+			return
+		}
+		if delay == 0 {
+			delay = time.Second
+		} else {
+			delay *= 2
+		}
+		if delay > 5*time.Minute {
+			delay = 5 * time.Minute
+		}
+		contextLog.Infof("推送失败 %v, [%.0f]秒后重试", err, delay.Seconds())
+		time.Sleep(delay)
+	}
+}
+
+//签名内容为 时间戳 + "." + 报文
+func (h *webhookHandler) post(hook WebhookConfig, name string, buff []byte) (err error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(buff))
+	if err != nil {
+		err = fmt.Errorf("POST %s 出错 %v", hook.URL, err)
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Control-Event", name)
+	req.Header.Set("X-Control-Timestamp", timestamp)
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(buff)
+		req.Header.Set("X-Control-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("POST %s 出错 %v", hook.URL, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("POST %s 返回错误代码 %s", hook.URL, resp.Status)
+	}
+	return
+}
+
+//查询最近的事件
+func (s *Server) eventList(w http.ResponseWriter, r *http.Request) {
+	contextLog := s.contextLog.WithField("func", "查询事件")
+	if err := r.ParseForm(); err != nil {
+		contextLog.WithField("msg", "r.ParseForm").Errorln(err)
+		return
+	}
+	op := operatorFrom(r)
+	events := []*boxEvent{}
+	for _, ev := range s.events.List(r.FormValue("endsn")) {
+		if op.CanAccess(ev.Account) {
+			events = append(events, ev)
+		}
+	}
+	buff, err := json.Marshal(events)
+	if err != nil {
+		contextLog.WithField("msg", "json 打包").Errorln(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buff)
+}
@@ -20,9 +20,14 @@ func (s *Server) downloadFile(w http.ResponseWriter, r *http.Request) {
 		contextLog.Errorf("未能取到正确endsn")
 		return
 	}
+	if !s.allowBox(r, endsn) {
+		s.denyBox(w, r, endsn)
+		return
+	}
 	//读取配置文件
 	filename := fmt.Sprintf("./file/%s/easy.db", endsn)
 	buff, err := ioutil.ReadFile(filename)
+	s.record(r, "download", endsn, "", auditResult(err), err)
 	if err != nil {
 		contextLog.Errorf("读取db文件出错 %v", err)
 		w.WriteHeader(http.StatusNotFound)
@@ -37,18 +42,26 @@ func (s *Server) downloadFile(w http.ResponseWriter, r *http.Request) {
 func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request) {
 	contextLog := s.contextLog.WithField("func", "上传文件")
 	var err error
+	endsn := r.FormValue("endsn")
 	defer func() {
+		if endsn != "" {
+			s.record(r, "upload", endsn, "", auditResult(err), err)
+		}
 		if err != nil {
 			w.Write([]byte("上传失败"))
 		} else {
 			w.Write([]byte("上传成功"))
 		}
 	}()
-	endsn := r.FormValue("endsn")
 	if endsn == "" {
 		contextLog.Errorf("未能取到正确endsn")
 		return
 	}
+	if !s.allowBox(r, endsn) {
+		err = fmt.Errorf("没有权限访问此设备")
+		contextLog.WithField("endsn", endsn).Errorln(err)
+		return
+	}
 	file, _, err := r.FormFile("easy.db")
 	if err != nil {
 		contextLog.Errorf("r.FormFile %v", err)
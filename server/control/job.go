@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//任务状态
+const (
+	JobPending = "pending"
+	//box离线，等待box连接后执行
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobSuccess = "success"
+	JobFailed  = "failed"
+)
+
+//job 网页发起的每个操作对应一个任务
+type job struct {
+	ID     string
+	EndSn  string
+	Method string
+	State  string
+	//创建、开始和结束时间
+	Created time.Time
+	Start   time.Time
+	End     time.Time
+	//离线任务的过期时间
+	Expire time.Time
+	//box的返回结果
+	Result json.RawMessage `json:",omitempty"`
+	Error  string          `json:",omitempty"`
+}
+
+//Done 任务是否已经结束
+func (j *job) Done() bool {
+	return j.State == JobSuccess || j.State == JobFailed
+}
+
+//jobManager 保存最近的任务，超过最大数量将删除最早的任务
+type jobManager struct {
+	mu   *sync.Mutex
+	seq  uint64
+	size int
+	jobs map[string]*job
+	//按创建顺序保存任务ID
+	order []string
+}
+
+func newJobManager(size int) *jobManager {
+	m := new(jobManager)
+	m.mu = new(sync.Mutex)
+	m.size = size
+	m.jobs = make(map[string]*job)
+	return m
+}
+
+//Create 新建任务
+func (m *jobManager) Create(endsn, method string) *job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	j := new(job)
+	j.ID = fmt.Sprintf("%s-%d", time.Now().Format("20060102150405"), m.seq)
+	j.EndSn = endsn
+	j.Method = method
+	j.State = JobPending
+	j.Created = time.Now()
+	m.jobs[j.ID] = j
+	m.order = append(m.order, j.ID)
+	if len(m.order) > m.size {
+		delete(m.jobs, m.order[0])
+		m.order = m.order[1:]
+	}
+	c := *j
+	return &c
+}
+
+//Queue 任务进入离线队列，返回任务当前状态
+func (m *jobManager) Queue(id string, expire time.Time) (*job, bool) {
+	m.update(id, func(j *job) {
+		j.State = JobQueued
+		j.Expire = expire
+	})
+	return m.Get(id)
+}
+
+//Restore 恢复重启前未完成的离线任务
+func (m *jobManager) Restore(j *job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.jobs[j.ID]; ok {
+		return
+	}
+	c := *j
+	m.jobs[j.ID] = &c
+	m.order = append(m.order, j.ID)
+}
+
+//Begin 任务开始执行
+func (m *jobManager) Begin(id string) {
+	m.update(id, func(j *job) {
+		j.State = JobRunning
+		j.Start = time.Now()
+	})
+}
+
+//Run 在新的goroutine中执行任务，任务结束后关闭返回的chan
+func (m *jobManager) Run(id string, fn func() (json.RawMessage, error)) <-chan struct{} {
+	done := make(chan struct{})
+	m.Begin(id)
+	go func() {
+		defer close(done)
+		res, err := fn()
+		m.Finish(id, res, err)
+	}()
+	return done
+}
+
+//Finish 记录任务结果
+func (m *jobManager) Finish(id string, res json.RawMessage, err error) {
+	m.update(id, func(j *job) {
+		j.End = time.Now()
+		j.Result = res
+		if err != nil {
+			j.State = JobFailed
+			j.Error = err.Error()
+		} else {
+			j.State = JobSuccess
+		}
+	})
+}
+
+func (m *jobManager) update(id string, fn func(j *job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		fn(j)
+	}
+}
+
+//Get 根据ID查找任务
+func (m *jobManager) Get(id string) (*job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	c := *j
+	return &c, true
+}
+
+//List 按创建时间倒序返回任务，endsn为空时返回全部
+func (m *jobManager) List(endsn string) (jobs []*job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.order) - 1; i >= 0; i-- {
+		j := m.jobs[m.order[i]]
+		if endsn == "" || j.EndSn == endsn {
+			c := *j
+			jobs = append(jobs, &c)
+		}
+	}
+	return
+}
+
+//Latest 返回endsn最近的任务
+func (m *jobManager) Latest(endsn string) (*job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.order) - 1; i >= 0; i-- {
+		if j := m.jobs[m.order[i]]; j.EndSn == endsn {
+			c := *j
+			return &c, true
+		}
+	}
+	return nil, false
+}
+
+//查询任务，指定id时返回单个任务，否则按endsn查询
+func (s *Server) jobList(w http.ResponseWriter, r *http.Request) {
+	contextLog := s.contextLog.WithField("func", "查询任务")
+	if err := r.ParseForm(); err != nil {
+		contextLog.WithField("msg", "r.ParseForm").Errorln(err)
+		return
+	}
+	var v interface{}
+	if id := r.FormValue("id"); id != "" {
+		//不存在的任务和其他账号的任务返回相同的结果
+		j, ok := s.jobs.Get(id)
+		if !ok {
+			s.denyBox(w, r, "")
+			return
+		}
+		if !s.allowBox(r, j.EndSn) {
+			s.denyBox(w, r, j.EndSn)
+			return
+		}
+		v = j
+	} else {
+		endsn := r.FormValue("endsn")
+		if endsn != "" && !s.allowBox(r, endsn) {
+			s.denyBox(w, r, endsn)
+			return
+		}
+		jobs := []*job{}
+		for _, j := range s.jobs.List(endsn) {
+			if s.visible(r, j.EndSn) {
+				jobs = append(jobs, j)
+			}
+		}
+		v = jobs
+	}
+	buff, err := json.Marshal(v)
+	if err != nil {
+		contextLog.WithField("msg", "json 打包").Errorln(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buff)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//失败后等待时间的上限
+const maxLoginDelay = time.Minute
+
+//loginAttempt 每个IP或用户的登录失败记录
+type loginAttempt struct {
+	Key string
+	//连续失败次数，登录成功或解锁后清零
+	Failures int
+	Last     time.Time
+	//在此时间之前拒绝登录
+	Until time.Time
+	//是否已经锁定
+	Locked bool
+}
+
+//loginLimiter 按IP和用户统计登录失败次数
+//每次失败后需要等待1s,2s,4s...才能再次尝试，失败次数达到上限后锁定一段时间
+type loginLimiter struct {
+	mu          *sync.Mutex
+	name        string
+	maxFailures int
+	lockout     time.Duration
+	attempts    map[string]*loginAttempt
+	contextLog  *logrus.Entry
+}
+
+func newLoginLimiter(name string, maxFailures int, lockout time.Duration) *loginLimiter {
+	l := new(loginLimiter)
+	l.mu = new(sync.Mutex)
+	l.name = name
+	l.maxFailures = maxFailures
+	l.lockout = lockout
+	l.attempts = make(map[string]*loginAttempt)
+	l.contextLog = logrus.WithFields(logrus.Fields{"module": "limiter", "name": name})
+	return l
+}
+
+//登录限制的主键
+func ipKey(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "ip:" + addr
+}
+
+func userKey(user string) string {
+	return "user:" + user
+}
+
+//Check 检查是否允许登录，不允许时返回需要等待的时间
+func (l *loginLimiter) Check(keys ...string) (wait time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if a, exist := l.attempts[key]; exist && now.Before(a.Until) {
+			if d := a.Until.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait, wait == 0
+}
+
+//Allow 检查IP和用户是否允许登录，不允许时返回需要等待的时间
+//用户被限制时，没有失败记录的IP仍然可以尝试，避免他人用错误的密码锁定账号
+func (l *loginLimiter) Allow(ip, user string) (wait time.Duration, ok bool) {
+	if wait, ok = l.Check(ip); !ok {
+		return
+	}
+	if wait, ok = l.Check(user); ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, exist := l.attempts[ip]; !exist {
+		return 0, true
+	}
+	return
+}
+
+//Fail 记录登录失败
+func (l *loginLimiter) Fail(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.expire(now)
+	for _, key := range keys {
+		a, ok := l.attempts[key]
+		if !ok {
+			a = &loginAttempt{Key: key}
+			l.attempts[key] = a
+		}
+		a.Failures++
+		a.Last = now
+		if a.Failures >= l.maxFailures {
+			if !a.Locked {
+				l.contextLog.WithFields(logrus.Fields{"key": key, "failures": a.Failures}).Warnf("登录失败次数过多,锁定%s", l.lockout)
+			}
+			a.Locked = true
+			a.Until = now.Add(l.lockout)
+			continue
+		}
+		//逐次加倍到上限为止，失败次数很大时也不会溢出
+		delay := time.Second
+		for i := 1; i < a.Failures && delay < maxLoginDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxLoginDelay {
+			delay = maxLoginDelay
+		}
+		a.Until = now.Add(delay)
+	}
+}
+
+//Success 登录成功，清除失败记录
+func (l *loginLimiter) Success(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.attempts, key)
+	}
+}
+
+//Unlock 管理员解锁
+func (l *loginLimiter) Unlock(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.attempts[key]; !ok {
+		return false
+	}
+	delete(l.attempts, key)
+	l.contextLog.WithField("key", key).Info("解除锁定")
+	return true
+}
+
+//Reset 清除全部失败记录
+func (l *loginLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.attempts = make(map[string]*loginAttempt)
+	l.contextLog.Info("解除全部锁定")
+}
+
+//List 返回有失败记录的IP和用户
+func (l *loginLimiter) List() (attempts []*loginAttempt) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(time.Now())
+	for _, a := range l.attempts {
+		c := *a
+		attempts = append(attempts, &c)
+	}
+	sort.Slice(attempts, func(i, j int) bool {
+		return attempts[i].Key < attempts[j].Key
+	})
+	return
+}
+
+//删除锁定结束并且长时间没有失败的记录，需要在锁内调用
+func (l *loginLimiter) expire(now time.Time) {
+	for key, a := range l.attempts {
+		if now.After(a.Until) && now.Sub(a.Last) > l.lockout {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+//检查解锁文件的间隔
+const unlockCheckInterval = 5 * time.Second
+
+//watchUnlock 管理员无法登录网页时，在服务器上建立filename解除全部锁定
+//解锁后删除filename，重启程序也会清除全部锁定
+func (s *Server) watchUnlock(filename string) {
+	ticker := time.NewTicker(unlockCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := os.Stat(filename); err != nil {
+			continue
+		}
+		s.logins.Reset()
+		s.sshServer.limiter.Reset()
+		if err := os.Remove(filename); err != nil {
+			s.contextLog.WithField("msg", "删除解锁文件").Errorln(err)
+		}
+	}
+}
+
+//拒绝被限制的登录请求
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, "登录失败次数过多,请%d秒后重试", int(wait/time.Second)+1)
+}
+
+//查询和解除登录锁定
+//POST内容为 {"Name":"ssh|console","Key":"ip:1.2.3.4"}
+func (s *Server) lockoutList(w http.ResponseWriter, r *http.Request) {
+	contextLog := s.contextLog.WithField("func", "登录锁定")
+	res := struct {
+		Code    string
+		Msg     string
+		SSH     []*loginAttempt
+		Console []*loginAttempt
+	}{Code: "0000"}
+	if r.Method == "POST" {
+		var req struct {
+			Name string
+			Key  string
+		}
+		var err error
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			err = fmt.Errorf("解析json出错 %v", err)
+		} else {
+			var l *loginLimiter
+			switch req.Name {
+			case "ssh":
+				l = s.sshServer.limiter
+			case "console":
+				l = s.logins
+			}
+			if l == nil {
+				err = fmt.Errorf("没有这个类型 %s", req.Name)
+			} else if !l.Unlock(req.Key) {
+				err = fmt.Errorf("没有锁定记录 %s", req.Key)
+			}
+		}
+		s.record(r, "unlock."+req.Name, "", req.Key, auditResult(err), err)
+		if err != nil {
+			contextLog.Errorln(err)
+			res.Code = "9999"
+			res.Msg = err.Error()
+		}
+	}
+	res.SSH = s.sshServer.limiter.List()
+	res.Console = s.logins.List()
+	buff, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buff)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//云端发送ping的间隔
+	probeInterval = 10 * time.Second
+	//保存最近的采样数
+	linkWindow = 60
+	//超过以下任一阈值认为链路质量差
+	degradedRTT        = time.Second
+	degradedLoss       = 20
+	degradedReconnects = 3
+)
+
+//linkSample 每次ping的采样
+type linkSample struct {
+	Time time.Time
+	RTT  time.Duration
+	//下一次ping之前没有收到pong
+	Lost bool
+	//上一个周期内没有收到box的心跳
+	Missed bool
+}
+
+//LinkQuality 链路质量
+type LinkQuality struct {
+	//往返时延，单位毫秒
+	RTT    int64
+	MinRTT int64
+	MaxRTT int64
+	//丢包率，百分比
+	Loss int
+	//窗口内box心跳丢失次数
+	MissedHeartbeats int
+	//最近一小时重连次数
+	ReconnectsPerHour int
+	//采样数
+	Samples  int
+	Degraded bool
+}
+
+//linkStats 统计box连接的往返时延和心跳丢失
+//session重连后继续使用，保留最近linkWindow次采样
+type linkStats struct {
+	mu      *sync.Mutex
+	samples []*linkSample
+	//等待pong的采样
+	pending *linkSample
+	//最后一次收到box心跳的时间
+	lastBoxPing time.Time
+}
+
+func newLinkStats() *linkStats {
+	l := new(linkStats)
+	l.mu = new(sync.Mutex)
+	return l
+}
+
+//Reset 新的连接建立时调用
+func (l *linkStats) Reset(now time.Time) {
+	l.mu.Lock()
+	l.pending = nil
+	l.lastBoxPing = now
+	l.mu.Unlock()
+}
+
+//BoxPing 收到box的心跳
+func (l *linkStats) BoxPing(now time.Time) {
+	l.mu.Lock()
+	l.lastBoxPing = now
+	l.mu.Unlock()
+}
+
+//Ping 发送ping之前调用，返回ping的内容
+//上一次ping还没有收到pong将记为丢失
+func (l *linkStats) Ping(now time.Time) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending != nil {
+		l.pending.Lost = true
+	}
+	sample := &linkSample{Time: now}
+	sample.Missed = now.Sub(l.lastBoxPing) > probeInterval+probeInterval/2
+	l.samples = append(l.samples, sample)
+	if len(l.samples) > linkWindow {
+		l.samples = l.samples[len(l.samples)-linkWindow:]
+	}
+	l.pending = sample
+	return []byte(strconv.FormatInt(now.UnixNano(), 10))
+}
+
+//Pong 收到pong，data为ping的内容
+func (l *linkStats) Pong(data string, now time.Time) {
+	sent, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending == nil || l.pending.Time.UnixNano() != sent {
+		return
+	}
+	l.pending.RTT = now.Sub(l.pending.Time)
+	l.pending = nil
+}
+
+//Quality 计算窗口内的链路质量
+func (l *linkStats) Quality(reconnects int) *LinkQuality {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q := new(LinkQuality)
+	q.ReconnectsPerHour = reconnects
+	var total time.Duration
+	var lost, count int
+	for _, sample := range l.samples {
+		if sample.Missed {
+			q.MissedHeartbeats++
+		}
+		if sample == l.pending {
+			continue
+		}
+		q.Samples++
+		if sample.Lost {
+			lost++
+			continue
+		}
+		ms := int64(sample.RTT / time.Millisecond)
+		if count == 0 || ms < q.MinRTT {
+			q.MinRTT = ms
+		}
+		if ms > q.MaxRTT {
+			q.MaxRTT = ms
+		}
+		total += sample.RTT
+		count++
+	}
+	if count > 0 {
+		q.RTT = int64(total / time.Duration(count) / time.Millisecond)
+	}
+	if q.Samples > 0 {
+		q.Loss = lost * 100 / q.Samples
+	}
+	q.Degraded = time.Duration(q.RTT)*time.Millisecond > degradedRTT ||
+		q.Loss > degradedLoss ||
+		q.ReconnectsPerHour >= degradedReconnects
+	return q
+}
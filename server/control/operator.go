@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//操作员角色
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+//操作员权限
+const (
+	//查看box列表、事件和任务
+	PermView = "view"
+	//打开终端
+	PermTerminal = "terminal"
+	//生成、加载、推送、上传和下载配置
+	PermConfig = "config"
+	//更新box程序
+	PermUpdate = "update"
+	//管理操作员
+	PermAdmin = "admin"
+)
+
+//每个角色拥有的权限
+var rolePerms = map[string][]string{
+	RoleViewer:   {PermView},
+	RoleOperator: {PermView, PermTerminal, PermConfig, PermUpdate},
+	RoleAdmin:    {PermView, PermTerminal, PermConfig, PermUpdate, PermAdmin},
+}
+
+//网页method接口每个方法需要的权限
+var methodPerms = map[string]string{
+	"genpage":    PermConfig,
+	"loadconfig": PermConfig,
+	"pushconfig": PermConfig,
+	"ptyreq":     PermTerminal,
+	"update":     PermUpdate,
+	//执行命令与打开终端的权限相同
+	"exec": PermTerminal,
+}
+
+//登录校验结果缓存时间，避免每个请求都计算bcrypt
+const operatorCacheExpire = 5 * time.Minute
+
+//operator 网页操作员
+type operator struct {
+	Name string
+	//bcrypt加密后的密码
+	Password string `json:",omitempty"`
+	Role     string
+	//可以访问的box账号，为*时可以访问全部账号
+	Accounts []string
+	Created  time.Time
+}
+
+//Can 是否拥有权限
+func (o *operator) Can(perm string) bool {
+	for _, p := range rolePerms[o.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+//operatorStore 保存操作员，可以在多个goroutine中使用
+//操作员保存在文件中，文件不存在时将建立admin账号并在日志中输出随机密码
+type operatorStore struct {
+	mu       *sync.Mutex
+	filename string
+	//主键为操作员名称
+	operators map[string]*operator
+	//校验通过的账号密码摘要和过期时间
+	cache      map[string]time.Time
+	contextLog *logrus.Entry
+}
+
+func newOperatorStore(filename string) *operatorStore {
+	o := new(operatorStore)
+	o.mu = new(sync.Mutex)
+	o.filename = filename
+	o.operators = make(map[string]*operator)
+	o.cache = make(map[string]time.Time)
+	o.contextLog = logrus.WithField("module", "operator")
+	return o
+}
+
+//Load 从文件加载操作员
+func (o *operatorStore) Load() (err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	buff, err := ioutil.ReadFile(o.filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			err = fmt.Errorf("读取操作员文件出错 %v", err)
+			return
+		}
+		//第一次启动时建立管理员
+		passwd := make([]byte, 9)
+		if _, err = rand.Read(passwd); err != nil {
+			err = fmt.Errorf("生成密码出错 %v", err)
+			return
+		}
+		password := hex.EncodeToString(passwd)
+		if err = o.add("admin", password, RoleAdmin, []string{AllAccounts}); err != nil {
+			return
+		}
+		o.contextLog.Warnf("已建立管理员 admin, 密码 %s, 请登录后修改", password)
+		return
+	}
+	if err = json.Unmarshal(buff, &o.operators); err != nil {
+		err = fmt.Errorf("解析操作员文件出错 %v", err)
+	}
+	return
+}
+
+//保存操作员到文件，需要在锁内调用
+func (o *operatorStore) save() (err error) {
+	buff, err := json.Marshal(o.operators)
+	if err != nil {
+		err = fmt.Errorf("json 打包出错 %v", err)
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(o.filename), 0755); err != nil {
+		err = fmt.Errorf("建立文件夹出错 %v", err)
+		return
+	}
+	tmp := o.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, buff, 0600); err != nil {
+		err = fmt.Errorf("写入文件 %s 出错 %v", tmp, err)
+		return
+	}
+	if err = os.Rename(tmp, o.filename); err != nil {
+		err = fmt.Errorf("重命名文件 %s -> %s 出错 %v", tmp, o.filename, err)
+	}
+	return
+}
+
+//添加或修改操作员，需要在锁内调用
+func (o *operatorStore) add(name, password, role string, accounts []string) (err error) {
+	if name == "" || password == "" {
+		return fmt.Errorf("名称和密码不能为空")
+	}
+	if _, ok := rolePerms[role]; !ok {
+		return fmt.Errorf("没有这个角色 %s", role)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("加密密码出错 %v", err)
+	}
+	op, ok := o.operators[name]
+	if !ok {
+		op = &operator{Name: name, Created: time.Now()}
+		o.operators[name] = op
+	}
+	op.Password = string(hash)
+	op.Role = role
+	op.Accounts = accounts
+	//密码和角色修改后重新校验
+	o.cache = make(map[string]time.Time)
+	return o.save()
+}
+
+//Set 添加操作员，已经存在时修改密码和角色
+//by只能分配自己可以访问的账号，只能修改账号范围完全在自己范围内的操作员
+func (o *operatorStore) Set(by *operator, name, password, role string, accounts []string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !by.Covers(accounts) {
+		return fmt.Errorf("不能分配没有权限的账号 %v", accounts)
+	}
+	if op, ok := o.operators[name]; ok && !by.Covers(op.Accounts) {
+		return fmt.Errorf("没有权限修改操作员 %s", name)
+	}
+	return o.add(name, password, role, accounts)
+}
+
+//Delete 删除操作员，by只能删除账号范围完全在自己范围内的操作员
+func (o *operatorStore) Delete(by *operator, name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	op, ok := o.operators[name]
+	if !ok || !by.Covers(op.Accounts) {
+		return fmt.Errorf("没有这个操作员 %s", name)
+	}
+	delete(o.operators, name)
+	o.cache = make(map[string]time.Time)
+	return o.save()
+}
+
+//Login 校验账号密码，成功时返回操作员
+func (o *operatorStore) Login(name, password string) (*operator, bool) {
+	sum := sha256.Sum256([]byte(name + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+	o.mu.Lock()
+	op, ok := o.operators[name]
+	if !ok {
+		o.mu.Unlock()
+		return nil, false
+	}
+	c := *op
+	hash := op.Password
+	expire, cached := o.cache[key]
+	o.mu.Unlock()
+	if cached && time.Now().Before(expire) {
+		return &c, true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, false
+	}
+	o.mu.Lock()
+	//校验期间密码可能被修改
+	if cur, ok := o.operators[name]; ok && cur.Password == hash {
+		o.cache[key] = time.Now().Add(operatorCacheExpire)
+	}
+	o.mu.Unlock()
+	return &c, true
+}
+
+//List 按名称排序返回by可以管理的操作员，不包含密码
+func (o *operatorStore) List(by *operator) (ops []*operator) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, op := range o.operators {
+		if !by.Covers(op.Accounts) {
+			continue
+		}
+		c := *op
+		c.Password = ""
+		ops = append(ops, &c)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Name < ops[j].Name
+	})
+	return
+}
+
+type operatorKey struct{}
+
+//获取请求的操作员，经过operatorAuth的请求才有
+func operatorFrom(r *http.Request) *operator {
+	op, _ := r.Context().Value(operatorKey{}).(*operator)
+	return op
+}
+
+//operatorAuth 网页接口使用Basic认证，校验通过并且拥有权限perm后调用h
+func (s *Server) operatorAuth(perm string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, passwd, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Dotcoo User Login"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		keys := []string{ipKey(r.RemoteAddr), userKey(name)}
+		if wait, ok := s.logins.Allow(keys[0], keys[1]); !ok {
+			writeTooManyRequests(w, wait)
+			return
+		}
+		op, ok := s.operators.Login(name, passwd)
+		if !ok {
+			s.contextLog.WithFields(logrus.Fields{"operator": name, "addr": r.RemoteAddr}).Warnln("登录失败")
+			s.logins.Fail(keys...)
+			w.Header().Set("WWW-Authenticate", `Basic realm="Dotcoo User Login"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.logins.Success(keys...)
+		if !op.Can(perm) {
+			s.contextLog.WithFields(logrus.Fields{"operator": name, "path": r.URL.Path}).Warnln("没有权限")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), operatorKey{}, op)))
+	}
+}
+
+//管理操作员，GET返回可以管理的操作员，POST执行操作
+//只能管理账号范围在自己范围内的操作员，不能分配自己没有的账号
+//POST内容为 {"Action":"set|delete","Name":"","Password":"","Role":"","Accounts":[]}
+func (s *Server) operatorList(w http.ResponseWriter, r *http.Request) {
+	contextLog := s.contextLog.WithField("func", "管理操作员")
+	res := struct {
+		Code      string
+		Msg       string
+		Operators []*operator `json:",omitempty"`
+	}{Code: "0000"}
+	if r.Method == "POST" {
+		var req struct {
+			Action   string
+			Name     string
+			Password string
+			Role     string
+			Accounts []string
+		}
+		var err error
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			err = fmt.Errorf("解析json出错 %v", err)
+		} else {
+			switch req.Action {
+			case "set":
+				err = s.operators.Set(operatorFrom(r), req.Name, req.Password, req.Role, req.Accounts)
+			case "delete":
+				if req.Name == operatorFrom(r).Name {
+					err = fmt.Errorf("不能删除自己")
+				} else {
+					err = s.operators.Delete(operatorFrom(r), req.Name)
+				}
+			default:
+				err = fmt.Errorf("没有这个操作 %s", req.Action)
+			}
+		}
+		s.record(r, "operator."+req.Action, "", req.Name, auditResult(err), err)
+		if err != nil {
+			contextLog.WithField("msg", req.Action).Errorln(err)
+			res.Code = "9999"
+			res.Msg = err.Error()
+		} else {
+			contextLog.WithFields(logrus.Fields{"operator": operatorFrom(r).Name, "action": req.Action, "name": req.Name, "role": req.Role, "accounts": req.Accounts}).Info("修改操作员")
+		}
+	}
+	res.Operators = s.operators.List(operatorFrom(r))
+	buff, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buff)
+}
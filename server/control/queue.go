@@ -0,0 +1,256 @@
+package main
+
+import (
+	"easy/control/protocol"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//offlineQueue box离线时发起的任务将保存在这里，
+//box重新连接后按顺序执行，队列保存在文件中，重启后不会丢失
+type offlineQueue struct {
+	mu       *sync.Mutex
+	filename string
+	//主键为endsn，按加入顺序保存
+	jobs map[string][]*job
+	//正在执行队列的endsn
+	delivering map[string]bool
+	contextLog *logrus.Entry
+}
+
+func newOfflineQueue(filename string) *offlineQueue {
+	q := new(offlineQueue)
+	q.mu = new(sync.Mutex)
+	q.filename = filename
+	q.jobs = make(map[string][]*job)
+	q.delivering = make(map[string]bool)
+	q.contextLog = logrus.WithField("module", "queue")
+	return q
+}
+
+//Load 从文件加载队列，文件不存在时为空队列
+func (q *offlineQueue) Load() (err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	buff, err := ioutil.ReadFile(q.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		err = fmt.Errorf("读取队列文件出错 %v", err)
+		return
+	}
+	if err = json.Unmarshal(buff, &q.jobs); err != nil {
+		err = fmt.Errorf("解析队列文件出错 %v", err)
+	}
+	return
+}
+
+//保存队列到文件，先写入临时文件再替换
+func (q *offlineQueue) save() (err error) {
+	buff, err := json.Marshal(q.jobs)
+	if err != nil {
+		err = fmt.Errorf("json 打包出错 %v", err)
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(q.filename), 0755); err != nil {
+		err = fmt.Errorf("建立文件夹出错 %v", err)
+		return
+	}
+	tmp := q.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, buff, 0660); err != nil {
+		err = fmt.Errorf("写入文件 %s 出错 %v", tmp, err)
+		return
+	}
+	if err = os.Rename(tmp, q.filename); err != nil {
+		err = fmt.Errorf("重命名文件 %s -> %s 出错 %v", tmp, q.filename, err)
+	}
+	return
+}
+
+//Push 任务加入队列
+func (q *offlineQueue) Push(j *job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs[j.EndSn] = append(q.jobs[j.EndSn], j)
+	return q.save()
+}
+
+//Front 返回endsn最早加入的任务
+func (q *offlineQueue) Front(endsn string) (*job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if jobs := q.jobs[endsn]; len(jobs) > 0 {
+		return jobs[0], true
+	}
+	return nil, false
+}
+
+//Remove 从队列中删除任务
+func (q *offlineQueue) Remove(endsn, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := q.jobs[endsn]
+	for i, j := range jobs {
+		if j.ID == id {
+			jobs = append(jobs[:i:i], jobs[i+1:]...)
+			break
+		}
+	}
+	if len(jobs) == 0 {
+		delete(q.jobs, endsn)
+	} else {
+		q.jobs[endsn] = jobs
+	}
+	return q.save()
+}
+
+//Expired 删除并返回已经过期的任务
+func (q *offlineQueue) Expired(now time.Time) (expired []*job, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for endsn, jobs := range q.jobs {
+		var left []*job
+		for _, j := range jobs {
+			if now.After(j.Expire) {
+				expired = append(expired, j)
+			} else {
+				left = append(left, j)
+			}
+		}
+		if len(left) == 0 {
+			delete(q.jobs, endsn)
+		} else {
+			q.jobs[endsn] = left
+		}
+	}
+	if len(expired) > 0 {
+		err = q.save()
+	}
+	return
+}
+
+//All 返回队列中全部任务
+func (q *offlineQueue) All() (all []*job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, jobs := range q.jobs {
+		all = append(all, jobs...)
+	}
+	return
+}
+
+//Len 返回endsn队列中的任务数
+func (q *offlineQueue) Len(endsn string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs[endsn])
+}
+
+//同一个endsn同时只能有一个goroutine执行队列
+func (q *offlineQueue) lock(endsn string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.delivering[endsn] {
+		return false
+	}
+	q.delivering[endsn] = true
+	return true
+}
+
+func (q *offlineQueue) unlock(endsn string) {
+	q.mu.Lock()
+	delete(q.delivering, endsn)
+	q.mu.Unlock()
+}
+
+//box连接后按顺序执行离线队列中的任务
+//box再次断开时停止执行，剩下的任务等待下次连接
+//执行中连接断开的任务重新排队，只有box返回结果后才从队列中删除
+func (s *Server) deliver(endsn string) {
+	for {
+		if !s.queue.lock(endsn) {
+			return
+		}
+		offline := s.deliverQueue(endsn)
+		s.queue.unlock(endsn)
+		//box断开后又重新连接时，新连接启动的执行可能因为拿不到锁已经退出，这里重新检查
+		if !offline || s.queue.Len(endsn) == 0 {
+			return
+		}
+		if _, ok := s.boxs.Online(endsn); !ok {
+			return
+		}
+	}
+}
+
+//执行队列中的任务，因为box离线而停止时返回true
+func (s *Server) deliverQueue(endsn string) (offline bool) {
+	contextLog := s.contextLog.WithFields(logrus.Fields{"func": "执行离线队列", "endsn": endsn})
+	for {
+		j, ok := s.queue.Front(endsn)
+		if !ok {
+			return false
+		}
+		box, ok := s.boxs.Online(endsn)
+		if !ok {
+			return true
+		}
+		fn, _, ok := s.methodFunc(j.Method, endsn, "", nil)
+		switch {
+		case time.Now().After(j.Expire):
+			s.jobs.Finish(j.ID, nil, fmt.Errorf("任务已过期"))
+		case !ok || !queueMethods[j.Method]:
+			//队列文件中不能离线执行的方法
+			s.jobs.Finish(j.ID, nil, fmt.Errorf("方法[%s]不能离线执行", j.Method))
+		default:
+			contextLog.WithFields(logrus.Fields{"job": j.ID, "method": j.Method}).Info("开始执行")
+			gen := box.Gen()
+			s.jobs.Begin(j.ID)
+			res, err := fn()
+			if err != nil && s.disconnected(endsn, gen, err) {
+				contextLog.WithFields(logrus.Fields{"job": j.ID, "msg": "执行中连接断开，任务重新排队"}).Warnln(err)
+				s.jobs.Queue(j.ID, j.Expire)
+				continue
+			}
+			s.jobs.Finish(j.ID, res, err)
+		}
+		if err := s.queue.Remove(endsn, j.ID); err != nil {
+			contextLog.WithField("msg", "删除队列任务").Errorln(err)
+			return false
+		}
+	}
+}
+
+//任务出错是否因为box连接断开，box返回的错误不算
+//同一个endsn重连后session不变，根据连接序号判断是否已经重新连接
+func (s *Server) disconnected(endsn string, gen uint64, err error) bool {
+	if _, ok := err.(*protocol.Error); ok {
+		return false
+	}
+	box, ok := s.boxs.Online(endsn)
+	return !ok || box.Gen() != gen
+}
+
+//定时清理过期的离线任务
+func (s *Server) expireQueue() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		jobs, err := s.queue.Expired(time.Now())
+		if err != nil {
+			s.contextLog.WithField("msg", "清理过期任务").Errorln(err)
+		}
+		for _, j := range jobs {
+			s.jobs.Finish(j.ID, nil, fmt.Errorf("任务已过期"))
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+//asciicast v2 事件类型
+const (
+	castOutput = "o"
+	castInput  = "i"
+)
+
+//recordingInfo 终端录像的索引
+type recordingInfo struct {
+	ID       string
+	EndSn    string
+	Account  string
+	Operator string
+	//终端会话ID
+	Session string `json:",omitempty"`
+	Start   time.Time
+	//录像时长，查询时根据文件修改时间计算
+	Duration int64 `json:",omitempty"`
+}
+
+//castHeader asciicast v2 文件头
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title"`
+	Env       map[string]string `json:"env"`
+}
+
+//recorder 将终端的输入输出按asciicast v2格式写入文件
+type recorder struct {
+	mu    *sync.Mutex
+	file  *os.File
+	start time.Time
+	//不完整的utf8字符留到下次写入
+	pending map[string][]byte
+}
+
+//Write 写入一个事件，写入失败时返回错误
+func (r *recorder) Write(kind string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data = append(r.pending[kind], data...)
+	n := utf8Boundary(data)
+	r.pending[kind] = append([]byte(nil), data[n:]...)
+	if n == 0 {
+		return nil
+	}
+	elapsed := time.Since(r.start).Seconds()
+	buff, err := json.Marshal([]interface{}{elapsed, kind, string(data[:n])})
+	if err != nil {
+		return fmt.Errorf("json 打包出错 %v", err)
+	}
+	buff = append(buff, '\n')
+	if _, err = r.file.Write(buff); err != nil {
+		return fmt.Errorf("写入录像出错 %v", err)
+	}
+	return nil
+}
+
+//Close 关闭录像文件
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+//返回最后一个完整utf8字符之后的位置
+func utf8Boundary(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+//recordingStore 保存终端录像，索引为每行一个json
+type recordingStore struct {
+	mu  *sync.Mutex
+	dir string
+	seq uint64
+	//主键为录像ID，第一次查找时从索引加载
+	byID       map[string]*recordingInfo
+	contextLog *logrus.Entry
+}
+
+func newRecordingStore(dir string) *recordingStore {
+	s := new(recordingStore)
+	s.mu = new(sync.Mutex)
+	s.dir = dir
+	s.contextLog = logrus.WithField("module", "recording")
+	return s
+}
+
+func (s *recordingStore) index() string {
+	return filepath.Join(s.dir, "index.log")
+}
+
+func (s *recordingStore) path(id string) string {
+	return filepath.Join(s.dir, id+".cast")
+}
+
+//Start 开始录像，写入文件头和索引
+func (s *recordingStore) Start(info *recordingInfo, width, height int) (rec *recorder, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = os.MkdirAll(s.dir, 0750); err != nil {
+		err = fmt.Errorf("建立文件夹出错 %v", err)
+		return
+	}
+	s.seq++
+	info.ID = fmt.Sprintf("%s-%s-%d", info.EndSn, info.Start.Format("20060102150405"), s.seq)
+	if filepath.Base(info.ID) != info.ID {
+		err = fmt.Errorf("endsn格式错误 %s", info.EndSn)
+		return
+	}
+	file, err := os.OpenFile(s.path(info.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		err = fmt.Errorf("建立录像文件出错 %v", err)
+		return
+	}
+	header := &castHeader{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: info.Start.Unix(),
+		Title:     fmt.Sprintf("%s %s", info.EndSn, info.Operator),
+		Env:       map[string]string{"TERM": "xterm-color"},
+	}
+	buff, _ := json.Marshal(header)
+	if _, err = file.Write(append(buff, '\n')); err != nil {
+		file.Close()
+		err = fmt.Errorf("写入录像出错 %v", err)
+		return
+	}
+	index, err := os.OpenFile(s.index(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		file.Close()
+		err = fmt.Errorf("打开录像索引出错 %v", err)
+		return
+	}
+	defer index.Close()
+	buff, _ = json.Marshal(info)
+	if _, err = index.Write(append(buff, '\n')); err != nil {
+		file.Close()
+		err = fmt.Errorf("写入录像索引出错 %v", err)
+		return
+	}
+	if s.byID != nil {
+		c := *info
+		s.byID[c.ID] = &c
+	}
+	rec = &recorder{mu: new(sync.Mutex), file: file, start: info.Start, pending: make(map[string][]byte)}
+	return
+}
+
+//List 按时间倒序返回录像
+func (s *recordingStore) List(endsn string, filter func(info *recordingInfo) bool) (infos []*recordingInfo, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.Open(s.index())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		err = fmt.Errorf("打开录像索引出错 %v", err)
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		info := new(recordingInfo)
+		if err := json.Unmarshal(scanner.Bytes(), info); err != nil {
+			continue
+		}
+		if endsn != "" && info.EndSn != endsn {
+			continue
+		}
+		if !filter(info) {
+			continue
+		}
+		if stat, err := os.Stat(s.path(info.ID)); err == nil {
+			info.Duration = int64(stat.ModTime().Sub(info.Start) / time.Second)
+		}
+		infos = append(infos, info)
+	}
+	for i, j := 0, len(infos)-1; i < j; i, j = i+1, j-1 {
+		infos[i], infos[j] = infos[j], infos[i]
+	}
+	err = scanner.Err()
+	return
+}
+
+//Get 根据ID查找录像
+func (s *recordingStore) Get(id string) (*recordingInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadIndex(); err != nil {
+		s.contextLog.WithField("msg", "加载录像索引").Errorln(err)
+		return nil, false
+	}
+	info, ok := s.byID[id]
+	if !ok {
+		return nil, false
+	}
+	c := *info
+	if stat, err := os.Stat(s.path(c.ID)); err == nil {
+		c.Duration = int64(stat.ModTime().Sub(c.Start) / time.Second)
+	}
+	return &c, true
+}
+
+//从索引文件加载全部录像，只加载一次，需要在锁内调用
+func (s *recordingStore) loadIndex() (err error) {
+	if s.byID != nil {
+		return
+	}
+	byID := make(map[string]*recordingInfo)
+	file, err := os.Open(s.index())
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.byID = byID
+			return nil
+		}
+		return fmt.Errorf("打开录像索引出错 %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		info := new(recordingInfo)
+		if err := json.Unmarshal(scanner.Bytes(), info); err != nil {
+			continue
+		}
+		byID[info.ID] = info
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("读取录像索引出错 %v", err)
+	}
+	s.byID = byID
+	return
+}
+
+//查找操作员可以访问的录像
+func (s *Server) findRecording(w http.ResponseWriter, r *http.Request) (*recordingInfo, bool) {
+	//不存在的录像和其他账号的录像返回相同的结果
+	info, ok := s.recordings.Get(r.FormValue("id"))
+	if !ok {
+		s.denyBox(w, r, "")
+		return nil, false
+	}
+	if !s.allowBox(r, info.EndSn) {
+		s.denyBox(w, r, info.EndSn)
+		return nil, false
+	}
+	return info, true
+}
+
+//返回录像文件，asciicast v2 格式
+func (s *Server) recordingFile(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.findRecording(w, r)
+	if !ok {
+		return
+	}
+	s.record(r, "recording.view", info.EndSn, info.ID, AuditSuccess, nil)
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	http.ServeFile(w, r, s.recordings.path(info.ID))
+}
+
+//录像列表网页
+func (s *Server) recordingPage(w http.ResponseWriter, r *http.Request) {
+	op := operatorFrom(r)
+	infos, err := s.recordings.List(r.FormValue("endsn"), func(info *recordingInfo) bool {
+		return op.CanAccess(info.Account)
+	})
+	var trs []string
+	if err != nil {
+		trs = append(trs, fmt.Sprintf(`<tr class="am-danger"><td colspan="5">%s</td></tr>`, html.EscapeString(err.Error())))
+	}
+	for _, info := range infos {
+		trs = append(trs, fmt.Sprintf(`<tr>
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+        <td><a href="/replay?id=%s" target="_blank">回放</a></td>
+    </tr>`, info.Start.Format("2006-01-02 15:04:05"), html.EscapeString(info.EndSn), html.EscapeString(info.Operator),
+			time.Duration(info.Duration)*time.Second, html.EscapeString(url.QueryEscape(info.ID))))
+	}
+	page := fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>终端录像</title>
+    <link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/amazeui/2.7.2/css/amazeui.min.css"/>
+</head>
+<body>
+<form class="am-form-inline" method="GET" action="/recordingPage">
+    <input type="text" class="am-form-field" name="endsn" placeholder="Endsn" value="%s">
+    <button type="submit" class="am-btn am-btn-primary">查询</button>
+    <a href="/">返回</a>
+</form>
+<table class="am-table am-table-bordered am-table-radius am-table-compact am-text-nowrap">
+    <thead>
+    <tr>
+        <th>开始时间</th>
+        <th>Endsn</th>
+        <th>操作员</th>
+        <th>时长</th>
+        <th>回放</th>
+    </tr>
+    </thead>
+    <tbody>
+    %s
+    </tbody>
+</table>
+</body>
+</html>`, html.EscapeString(r.FormValue("endsn")), strings.Join(trs, "\n"))
+	w.Write([]byte(page))
+}
+
+//录像回放网页
+func (s *Server) replayPage(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.findRecording(w, r)
+	if !ok {
+		return
+	}
+	id, _ := json.Marshal("/recording?id=" + url.QueryEscape(info.ID))
+	page := fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>终端回放 %s</title>
+    <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/asciinema-player@3.6.3/dist/bundle/asciinema-player.css" />
+</head>
+<body>
+<p>%s %s %s</p>
+<div id="player"></div>
+<script src="https://cdn.jsdelivr.net/npm/asciinema-player@3.6.3/dist/bundle/asciinema-player.min.js"></script>
+<script>
+    AsciinemaPlayer.create(%s, document.getElementById("player"));
+</script>
+</body>
+</html>`, html.EscapeString(info.EndSn), html.EscapeString(info.EndSn), html.EscapeString(info.Operator),
+		info.Start.Format("2006-01-02 15:04:05"), id)
+	w.Write([]byte(page))
+}
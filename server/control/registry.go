@@ -0,0 +1,381 @@
+package main
+
+import (
+	"easy/control/protocol"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+//boxRecord 每个endsn的连接记录
+type boxRecord struct {
+	EndSn   string
+	Account string
+	Online  bool
+	//第一次连接时间
+	FirstSeen time.Time
+	//最后一次连接和断开的时间
+	LastConnect    time.Time
+	LastDisconnect time.Time
+	//最后一次连接的地址
+	RemoteAddr string
+	//最后一次断开的原因
+	DisconnectReason string
+	//重连次数
+	Reconnects int
+	//离线超时事件已经发送，重新连接后重置
+	OfflineNotified bool
+	//box最后一次上报的设备信息
+	Info *protocol.BoxInfo
+	//最近的连接时间，用于计算重连频率
+	ConnectTimes []time.Time
+	//链路质量，查询时计算
+	Link *LinkQuality `json:",omitempty"`
+	//当前打开的终端会话，查询时填写
+	Terminals []*termSession `json:",omitempty"`
+	session   *session
+}
+
+//连接被新的连接替换时的断开原因
+const reasonReplaced = "连接被替换"
+
+//registry 保存所有box的连接和连接记录，可以在多个goroutine中使用
+//连接记录保存在文件中，重启后不会丢失
+type registry struct {
+	mu *sync.RWMutex
+	//同一时间只处理一个新连接，保证替换连接的顺序
+	cmu *sync.Mutex
+	//发送上下线事件的锁，保证事件的顺序与状态修改的顺序一致
+	pmu      *sync.Mutex
+	filename string
+	//主键为endsn
+	boxs map[string]*boxRecord
+	//连接记录修改后尚未保存
+	dirty      bool
+	bus        *eventBus
+	contextLog *logrus.Entry
+}
+
+func newRegistry(filename string, bus *eventBus) *registry {
+	r := new(registry)
+	r.mu = new(sync.RWMutex)
+	r.cmu = new(sync.Mutex)
+	r.pmu = new(sync.Mutex)
+	r.filename = filename
+	r.boxs = make(map[string]*boxRecord)
+	r.bus = bus
+	r.contextLog = logrus.WithField("module", "registry")
+	return r
+}
+
+//Load 从文件加载连接记录，文件不存在时为空
+func (r *registry) Load() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	buff, err := ioutil.ReadFile(r.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		err = fmt.Errorf("读取连接记录出错 %v", err)
+		return
+	}
+	if err = json.Unmarshal(buff, &r.boxs); err != nil {
+		err = fmt.Errorf("解析连接记录出错 %v", err)
+		return
+	}
+	for _, rec := range r.boxs {
+		rec.Online = false
+	}
+	return
+}
+
+//标记连接记录已经修改，由AutoSave保存，需要在锁内调用
+func (r *registry) markDirty() {
+	r.dirty = true
+}
+
+//AutoSave 定时保存修改过的连接记录，写文件时不持有锁，不影响box连接
+func (r *registry) AutoSave(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.flush()
+	}
+}
+
+//在锁内打包连接记录，在锁外写入文件，写入失败时下次重试
+func (r *registry) flush() {
+	r.mu.Lock()
+	if !r.dirty {
+		r.mu.Unlock()
+		return
+	}
+	buff, err := json.Marshal(r.boxs)
+	r.dirty = false
+	r.mu.Unlock()
+	if err != nil {
+		r.contextLog.WithField("msg", "json 打包").Errorln(err)
+		return
+	}
+	if err = r.write(buff); err != nil {
+		r.contextLog.WithField("msg", "保存连接记录").Errorln(err)
+		r.mu.Lock()
+		r.dirty = true
+		r.mu.Unlock()
+	}
+}
+
+//先写入临时文件再重命名，避免写入中断时文件损坏
+func (r *registry) write(buff []byte) (err error) {
+	if err = os.MkdirAll(filepath.Dir(r.filename), 0755); err != nil {
+		err = fmt.Errorf("建立文件夹出错 %v", err)
+		return
+	}
+	tmp := r.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, buff, 0660); err != nil {
+		err = fmt.Errorf("写入连接记录出错 %v", err)
+		return
+	}
+	if err = os.Rename(tmp, r.filename); err != nil {
+		err = fmt.Errorf("重命名连接记录出错 %v", err)
+	}
+	return
+}
+
+//Connect box新建连接，如果连接已经存在则替换
+func (r *registry) Connect(endsn, account string, conn *websocket.Conn) (box *session, replaced bool) {
+	r.cmu.Lock()
+	defer r.cmu.Unlock()
+
+	r.mu.Lock()
+	rec, ok := r.boxs[endsn]
+	if !ok {
+		rec = &boxRecord{EndSn: endsn, FirstSeen: time.Now()}
+		r.boxs[endsn] = rec
+	}
+	if rec.session == nil {
+		rec.session = newSession(endsn, r.bus)
+		rec.session.onStop = r.disconnected
+		rec.session.onInfo = r.updateInfo
+	}
+	box = rec.session
+	r.mu.Unlock()
+
+	//先断开原来的连接，断开记录将在disconnected中保存
+	if box.Status() == 1 {
+		replaced = true
+		box.Stop(reasonReplaced)
+	}
+	box.SetConn(conn, account)
+
+	r.pmu.Lock()
+	r.mu.Lock()
+	if ok {
+		rec.Reconnects++
+	}
+	oldAddr := rec.RemoteAddr
+	rec.Account = account
+	rec.Online = true
+	rec.OfflineNotified = false
+	rec.LastConnect = time.Now()
+	rec.ConnectTimes = append(rec.ConnectTimes, rec.LastConnect)
+	if len(rec.ConnectTimes) > 20 {
+		rec.ConnectTimes = rec.ConnectTimes[len(rec.ConnectTimes)-20:]
+	}
+	rec.RemoteAddr = conn.RemoteAddr().String()
+	r.markDirty()
+	var ev *boxEvent
+	if replaced {
+		ev = newPresenceEvent(EventBoxReplaced, protocol.LevelWarn, fmt.Sprintf("连接被替换,原地址 %s", oldAddr), rec)
+	} else {
+		ev = newPresenceEvent(EventBoxOnline, protocol.LevelInfo, "设备上线", rec)
+	}
+	r.mu.Unlock()
+
+	r.bus.Publish(ev)
+	r.pmu.Unlock()
+	box.Start()
+	return
+}
+
+//session断开时调用，记录断开时间和原因
+//box已经重新连接时gen与当前连接不同，不修改记录
+func (r *registry) disconnected(endsn, reason string, gen uint64) {
+	r.pmu.Lock()
+	defer r.pmu.Unlock()
+	r.mu.Lock()
+	rec, ok := r.boxs[endsn]
+	if !ok || rec.session.Gen() != gen {
+		r.mu.Unlock()
+		return
+	}
+	rec.Online = false
+	rec.LastDisconnect = time.Now()
+	rec.DisconnectReason = reason
+	r.markDirty()
+	//连接被替换时由Connect发送事件
+	var ev *boxEvent
+	if reason != reasonReplaced {
+		ev = newPresenceEvent(EventBoxOffline, protocol.LevelWarn, "设备离线", rec)
+	}
+	r.mu.Unlock()
+	if ev != nil {
+		r.bus.Publish(ev)
+	}
+}
+
+//box上报设备信息时调用
+func (r *registry) updateInfo(endsn string, info *protocol.BoxInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rec, ok := r.boxs[endsn]; ok {
+		rec.Info = info
+		r.markDirty()
+	}
+}
+
+//WatchOffline 定时检查离线超过after的box，每次离线只产生一次事件
+func (r *registry) WatchOffline(after time.Duration) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var evs []*boxEvent
+		r.pmu.Lock()
+		r.mu.Lock()
+		for _, rec := range r.boxs {
+			if rec.Online || rec.OfflineNotified || rec.LastDisconnect.IsZero() {
+				continue
+			}
+			if time.Since(rec.LastDisconnect) < after {
+				continue
+			}
+			rec.OfflineNotified = true
+			msg := fmt.Sprintf("设备离线超过%d分钟", after/time.Minute)
+			evs = append(evs, newPresenceEvent(EventBoxOfflineLong, protocol.LevelError, msg, rec))
+		}
+		if len(evs) > 0 {
+			r.markDirty()
+		}
+		r.mu.Unlock()
+		for _, ev := range evs {
+			r.bus.Publish(ev)
+		}
+		r.pmu.Unlock()
+	}
+}
+
+//Get 获取endsn的session，从未连接过的box返回false
+func (r *registry) Get(endsn string) (*session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rec, ok := r.boxs[endsn]
+	if !ok || rec.session == nil {
+		return nil, false
+	}
+	return rec.session, true
+}
+
+//Online 获取endsn在线的session
+func (r *registry) Online(endsn string) (*session, bool) {
+	box, ok := r.Get(endsn)
+	if !ok || box.Status() != 1 {
+		return nil, false
+	}
+	return box, true
+}
+
+//Record 获取endsn的连接记录
+func (r *registry) Record(endsn string) (*boxRecord, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rec, ok := r.boxs[endsn]
+	if !ok {
+		return nil, false
+	}
+	return rec.snapshot(), true
+}
+
+//复制连接记录并计算链路质量，需要在锁内调用
+func (rec *boxRecord) snapshot() *boxRecord {
+	c := *rec
+	if rec.session != nil {
+		var reconnects int
+		for i, t := range rec.ConnectTimes {
+			//第一次连接不算重连
+			if i == 0 && len(rec.ConnectTimes) == rec.Reconnects+1 {
+				continue
+			}
+			if time.Since(t) < time.Hour {
+				reconnects++
+			}
+		}
+		c.Link = rec.session.Link(reconnects)
+	}
+	return &c
+}
+
+//List 按endsn排序返回全部连接记录
+func (r *registry) List() (recs []*boxRecord) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rec := range r.boxs {
+		recs = append(recs, rec.snapshot())
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].EndSn < recs[j].EndSn
+	})
+	return
+}
+
+//查询box连接记录，指定endsn时返回单个记录
+func (s *Server) boxList(w http.ResponseWriter, r *http.Request) {
+	contextLog := s.contextLog.WithField("func", "查询box")
+	if err := r.ParseForm(); err != nil {
+		contextLog.WithField("msg", "r.ParseForm").Errorln(err)
+		return
+	}
+	var v interface{}
+	if endsn := r.FormValue("endsn"); endsn != "" {
+		//先检查权限，不存在的box和其他账号的box返回相同的结果
+		if !s.allowBox(r, endsn) {
+			s.denyBox(w, r, endsn)
+			return
+		}
+		rec, ok := s.boxs.Record(endsn)
+		if !ok {
+			s.denyBox(w, r, endsn)
+			return
+		}
+		rec.Terminals = s.sshServer.Sessions(endsn)
+		v = rec
+	} else {
+		op := operatorFrom(r)
+		recs := []*boxRecord{}
+		for _, rec := range s.boxs.List() {
+			if op.CanAccess(rec.Account) {
+				rec.Terminals = s.sshServer.Sessions(rec.EndSn)
+				recs = append(recs, rec)
+			}
+		}
+		v = recs
+	}
+	buff, err := json.Marshal(v)
+	if err != nil {
+		contextLog.WithField("msg", "json 打包").Errorln(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buff)
+}
@@ -9,14 +9,15 @@ import (
 
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"strings"
 
 	"crypto/md5"
 	"encoding/hex"
 
-	"bytes"
-
 	"time"
 
+	"easy/control/protocol"
 	"easy/emq"
 
 	"context"
@@ -34,7 +35,7 @@ const (
 type Server struct {
 	//box连接集合，box连接云端后将会存在在这里
 	//主键为endCode
-	boxs map[string]*session
+	boxs *registry
 	//服务端启动状态
 	status int32
 	mux    *http.ServeMux
@@ -44,30 +45,80 @@ type Server struct {
 	//ssh server
 	sshServer *sshServer
 	//mongodb conn
-	mongodb    *mgo.Session
+	mongodb *mgo.Session
+	cfg     *Config
+	//box上报的事件将通过bus分发
+	bus *eventBus
+	//最近的事件，供网页显示
+	events *recentEvents
+	//网页发起的操作任务
+	jobs *jobManager
+	//box离线时的任务队列
+	queue *offlineQueue
+	//box认证方式
+	auth authenticator
+	//网页操作员
+	operators *operatorStore
+	//操作员审计日志
+	audit *auditLog
+	//终端录像
+	recordings *recordingStore
+	//网页登录限制
+	logins     *loginLimiter
 	contextLog *logrus.Entry
 }
 
 //NewServer ...
-func NewServer() *Server {
+func NewServer(cfg *Config) *Server {
 	s := new(Server)
-	s.boxs = make(map[string]*session)
+	s.cfg = cfg
 	s.mux = http.NewServeMux()
 	s.upgrad = new(websocket.Upgrader)
 	s.upgrad.ReadBufferSize = 10240
 	s.upgrad.WriteBufferSize = 10240
 	s.contextLog = logrus.WithField("module", "control")
-	s.sshServer = newSSHServer()
+	lockout := time.Duration(cfg.LoginLockout) * time.Minute
+	s.sshServer = newSSHServer(newLoginLimiter("ssh", cfg.LoginMaxFailures, lockout),
+		time.Duration(cfg.TerminalIdle)*time.Minute, time.Duration(cfg.TerminalMax)*time.Minute)
+	s.logins = newLoginLimiter("console", cfg.LoginMaxFailures, lockout)
+	s.events = newRecentEvents(100)
+	s.jobs = newJobManager(1000)
+	s.queue = newOfflineQueue(filepath.Join(cfg.DataDir, "queue.json"))
+	s.bus = newEventBus()
+	s.boxs = newRegistry(filepath.Join(cfg.DataDir, "boxs.json"), s.bus)
+	s.operators = newOperatorStore(filepath.Join(cfg.DataDir, "operators.json"))
+	s.audit = newAuditLog(filepath.Join(cfg.DataDir, "audit.log"))
+	s.recordings = newRecordingStore(filepath.Join(cfg.DataDir, "recordings"))
+	s.bus.Subscribe(newLogHandler())
+	s.bus.Subscribe(s.events)
+	if len(cfg.Webhooks) > 0 {
+		s.bus.Subscribe(newWebhookHandler(cfg.Webhooks))
+	}
 	s.mux.HandleFunc("/control", s.control)
 	s.mux.HandleFunc("/update", s.control)
 	s.mux.HandleFunc("/dbfile", s.file)
 	s.mux.HandleFunc("/binfile", s.binfile)
-	s.mux.HandleFunc("/", s.showBoxList)
-	s.mux.HandleFunc("/sshWeb", s.sshWeb)
-	s.mux.HandleFunc("/terminal", s.ssh)
-	s.mux.HandleFunc("/method", s.method)
-	s.mux.HandleFunc("/upload", s.uploadFile)
-	s.mux.HandleFunc("/download", s.downloadFile)
+	s.mux.HandleFunc("/challenge", s.challenge)
+	//以下为网页接口，需要操作员登录
+	s.mux.HandleFunc("/", s.operatorAuth(PermView, s.showBoxList))
+	//打开和加入终端会话都需要终端权限，只读加入也能看到输入的内容
+	s.mux.HandleFunc("/sshWeb", s.operatorAuth(PermTerminal, s.sshWeb))
+	s.mux.HandleFunc("/terminal", s.operatorAuth(PermTerminal, s.ssh))
+	s.mux.HandleFunc("/terminals", s.operatorAuth(PermView, s.terminalList))
+	//method接口在执行前检查每个方法的权限
+	s.mux.HandleFunc("/method", s.operatorAuth(PermView, s.method))
+	s.mux.HandleFunc("/upload", s.operatorAuth(PermConfig, s.uploadFile))
+	s.mux.HandleFunc("/download", s.operatorAuth(PermConfig, s.downloadFile))
+	s.mux.HandleFunc("/events", s.operatorAuth(PermView, s.eventList))
+	s.mux.HandleFunc("/jobs", s.operatorAuth(PermView, s.jobList))
+	s.mux.HandleFunc("/boxs", s.operatorAuth(PermView, s.boxList))
+	s.mux.HandleFunc("/operators", s.operatorAuth(PermAdmin, s.operatorList))
+	s.mux.HandleFunc("/audit", s.operatorAuth(PermAdmin, s.auditList))
+	s.mux.HandleFunc("/auditPage", s.operatorAuth(PermAdmin, s.auditPage))
+	s.mux.HandleFunc("/recording", s.operatorAuth(PermAdmin, s.recordingFile))
+	s.mux.HandleFunc("/recordingPage", s.operatorAuth(PermAdmin, s.recordingPage))
+	s.mux.HandleFunc("/replay", s.operatorAuth(PermAdmin, s.replayPage))
+	s.mux.HandleFunc("/lockouts", s.operatorAuth(PermAdmin, s.lockoutList))
 	return s
 }
 
@@ -78,6 +129,36 @@ func (s *Server) ListenAndServe() (err error) {
 		return nil
 	}
 	defer atomic.StoreInt32(&s.status, 0)
+	if s.auth, err = newAuthenticator(s.cfg.Auth); err != nil {
+		return
+	}
+	if s.cfg.Auth.Mode == AuthNone {
+		s.contextLog.Warnln("未开启box认证，任何客户端都可以使用任意endsn连接")
+	}
+	//加载操作员
+	if err = s.operators.Load(); err != nil {
+		return
+	}
+	if err = s.audit.Open(); err != nil {
+		return
+	}
+	//加载box连接记录
+	if err = s.boxs.Load(); err != nil {
+		return
+	}
+	//加载离线任务队列，恢复未完成的任务
+	if err = s.queue.Load(); err != nil {
+		return
+	}
+	for _, j := range s.queue.All() {
+		s.jobs.Restore(j)
+	}
+	go s.expireQueue()
+	go s.boxs.AutoSave(time.Second)
+	go s.watchUnlock(filepath.Join(s.cfg.DataDir, "unlock"))
+	if s.cfg.OfflineAlarm > 0 {
+		go s.boxs.WatchOffline(time.Duration(s.cfg.OfflineAlarm) * time.Minute)
+	}
 	//初始化消息队列
 	/*
 		s.emq = esNats.NewNatsConn(time.Second)
@@ -110,11 +191,20 @@ func (s *Server) ListenAndServe() (err error) {
 			return
 		}
 	}()
-	return http.ListenAndServe(":10000", s.mux)
+	if !s.cfg.TLS.Enabled() {
+		return http.ListenAndServe(":10000", s.mux)
+	}
+	srv := &http.Server{Addr: ":10000", Handler: s.mux}
+	if srv.TLSConfig, err = s.cfg.TLS.serverConfig(); err != nil {
+		return
+	}
+	return srv.ListenAndServeTLS(s.cfg.TLS.Cert, s.cfg.TLS.Key)
 }
 
 //负责处理伪终端请求
-//这里将根据get参数获取endsn,查找endsn连接和网页进行通信
+//这里将根据get参数获取endsn和会话ID,查找会话的管道和网页进行通信
+//每个网页终端使用自己的会话，关闭时不影响其它会话
+//mode为read或write时加入其他操作员已经打开的会话，box的输出同时发送给会话的全部网页
 func (s *Server) ssh(w http.ResponseWriter, r *http.Request) {
 	contextLog := s.contextLog.WithField("func", "与网页进行websocket通信")
 	if err := r.ParseForm(); err != nil {
@@ -126,64 +216,94 @@ func (s *Server) ssh(w http.ResponseWriter, r *http.Request) {
 		contextLog.WithField("msg", "FormValue(endsn)").Errorln("未能获取正确Endsn")
 		return
 	}
+	if !s.allowBox(r, endsn) {
+		s.denyBox(w, r, endsn)
+		return
+	}
+	id := r.FormValue("session")
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = TermOwner
+	}
+	if !s.allowTerminal(w, r, endsn, mode) {
+		return
+	}
 	conn, err := s.upgrad.Upgrade(w, r, nil)
 	if err != nil {
 		contextLog.WithField("msg", "websocket Upgrade").Errorln(err)
 		return
 	}
+	defer conn.Close()
+	operator := operatorFrom(r).Name
+	v := newTermViewer(conn, operator, mode)
+	defer v.Close()
+	if mode != TermOwner {
+		s.joinTerminal(r, v, endsn, id)
+		return
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	ok, channel := s.sshServer.GetChannel(ctx, endsn)
-	if !ok {
+	sess, err := s.sshServer.GetChannel(ctx, id, v)
+	if err == nil {
+		//网页断开时关闭会话，box上的shell随之退出，加入会话的网页也将断开
+		defer s.sshServer.Close(id)
+		if sess.EndSn != endsn {
+			err = fmt.Errorf("终端会话[%s]不属于设备[%s]", id, endsn)
+		}
+	}
+	if err != nil {
 		contextLog.WithField("msg", "sshServer GetChannel").Errorln(err)
+		s.record(r, "terminal.open", endsn, id, AuditFailed, err)
+		return
+	}
+	channel := sess.channel
+	//录像失败时不打开终端
+	info := &recordingInfo{EndSn: endsn, Operator: operator, Session: id, Start: time.Now()}
+	info.Account, _ = s.boxs.Account(endsn)
+	rec, err := s.recordings.Start(info, defaultCols, defaultRows)
+	if err != nil {
+		contextLog.WithField("msg", "开始录像").Errorln(err)
+		s.record(r, "terminal.open", endsn, id, AuditFailed, err)
 		return
 	}
-	go func(conn *websocket.Conn) {
+	defer func() {
+		//先关闭会话，加入的网页不再写入录像
+		s.sshServer.Close(id)
+		rec.Close()
+	}()
+	s.sshServer.SetRecorder(id, rec)
+	start := time.Now()
+	s.record(r, "terminal.open", endsn, info.ID, AuditSuccess, nil)
+	defer func() {
+		s.record(r, "terminal.close", endsn, fmt.Sprintf("%s 时长 %s", info.ID, time.Since(start).Truncate(time.Second)), AuditSuccess, nil)
+	}()
+	done := make(chan struct{})
+	defer close(done)
+	go s.watchTerminal(r, endsn, id, done)
+	go func() {
+		//box断开时关闭会话
+		defer s.sshServer.Close(id)
 		buff := make([]byte, 10240)
 		for {
 			n, err := channel.Read(buff)
 			if err != nil {
-				if conn != nil {
-					conn.Close()
-				}
 				contextLog.WithField("msg", "websocket channel Read").Errorln(err)
 				return
 			}
-			if err = conn.WriteMessage(websocket.TextMessage, buff[:n]); err != nil {
-				contextLog.WithField("msg", "websocket conn WriteMessage").Errorln(err)
-				return
+			if err = rec.Write(castOutput, buff[:n]); err != nil {
+				contextLog.WithField("msg", "录像").Errorln(err)
 			}
+			s.sshServer.Broadcast(id, buff[:n])
 		}
-
-	}(conn)
-	for {
-		_, buff, err := conn.ReadMessage()
-		if err != nil {
-			contextLog.WithField("msg", "websocket conn ReadMessage").Errorln(err)
-			return
-		}
-		_, err = channel.Write(buff)
-		if err != nil {
-			contextLog.WithField("msg", "sshServer channel Wirte").Errorln(err)
-			return
-
-		}
-	}
+	}()
+	s.termInput(id, v, channel, rec)
 }
 
 //负责推送更新配置信息，使用websocket协议
 //如果有新的链接来时将替换老的链接
 func (s *Server) control(w http.ResponseWriter, r *http.Request) {
 	contextLog := s.contextLog.WithField("func", "box新建连接到这里")
-	//校验cookie
-	/*
-		if err := s.verify(r); err != nil {
-			contextLog.WithField("msg", "校验cookie").Errorln(err)
-			w.Write([]byte(err.Error()))
-			return
-		}
-	*/
 	//获取endsn
 	var endsn string
 	var account string
@@ -199,6 +319,12 @@ func (s *Server) control(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	account = v.Value
+	//校验box证书和身份
+	if err := s.authenticate(r, endsn); err != nil {
+		contextLog.WithFields(logrus.Fields{"endsn": endsn, "msg": "校验身份"}).Errorln(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
 	conn, err := s.upgrad.Upgrade(w, r, nil)
 	if err != nil {
@@ -207,18 +333,13 @@ func (s *Server) control(w http.ResponseWriter, r *http.Request) {
 	}
 	contextLog.WithFields(logrus.Fields{"account": account, "endsn": endsn}).Infof("收到连接 %s", conn.RemoteAddr())
 	//检查链接是否已经存在，如果存在则替换
-	if box, ok := s.boxs[endsn]; ok {
+	if _, replaced := s.boxs.Connect(endsn, account, conn); replaced {
 		contextLog.WithFields(logrus.Fields{"account": account, "endsn": endsn, "addr": conn.RemoteAddr()}).Info("连接已存在替换")
-		box.Stop()
-		box.SetConn(conn, account)
-		box.Start()
 	} else {
 		contextLog.WithFields(logrus.Fields{"account": account, "endsn": endsn, "addr": conn.RemoteAddr()}).Info("连接不存在新建")
-		b := newSession()
-		b.SetConn(conn, account)
-		b.Start()
-		s.boxs[endsn] = b
 	}
+	//执行离线时加入队列的任务
+	go s.deliver(endsn)
 }
 
 func (s *Server) binfile(w http.ResponseWriter, r *http.Request) {
@@ -253,6 +374,11 @@ func (s *Server) binfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	endsn = v.Value
+	if err := s.authenticate(r, endsn); err != nil {
+		contextLog.WithFields(logrus.Fields{"endsn": endsn, "msg": "校验身份"}).Errorln(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	//如果是POST方法则为获取文件信息
 	if r.Method == "POST" {
 		var res struct {
@@ -261,7 +387,21 @@ func (s *Server) binfile(w http.ResponseWriter, r *http.Request) {
 			URL     string
 			Version string
 			MD5     string
+			//签名文件中的SHA-256和签名，box校验通过后才会更新
+			SHA256    string
+			Signature string
 		}
+		release, err := s.loadRelease(GOOS, GOARCH, Version)
+		if err != nil {
+			contextLog.WithField("msg", "读取签名文件").Errorln(err)
+			res.Code = "9999"
+			res.Msg = err.Error()
+			buff, _ := json.Marshal(res)
+			w.Write(buff)
+			return
+		}
+		res.SHA256 = release.SHA256
+		res.Signature = release.Signature
 		var u string
 		if GOOS == "windows" {
 			u = fmt.Sprintf("%s/updatefile/%s/%s_%s_%s/box.exe", CDNAddr, endsn, GOOS, GOARCH, Version)
@@ -276,18 +416,34 @@ func (s *Server) binfile(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//读取发布文件的签名，签名文件由release工具生成
+//保存在 {DataDir}/release/{GOOS}_{GOARCH}_{Version}.json
+func (s *Server) loadRelease(goos, goarch, version string) (release *protocol.Release, err error) {
+	name := fmt.Sprintf("%s_%s_%s.json", goos, goarch, version)
+	if filepath.Base(name) != name || strings.Contains(name, "..") {
+		err = fmt.Errorf("版本格式错误 %s", name)
+		return
+	}
+	buff, err := ioutil.ReadFile(filepath.Join(s.cfg.DataDir, "release", name))
+	if err != nil {
+		err = fmt.Errorf("没有此版本的签名文件 %v", err)
+		return
+	}
+	release = new(protocol.Release)
+	if err = json.Unmarshal(buff, release); err != nil {
+		err = fmt.Errorf("解析签名文件出错 %v", err)
+		return
+	}
+	if release.GOOS != goos || release.GOARCH != goarch || release.Version != version {
+		err = fmt.Errorf("签名文件 %s 内容与文件名不一致", name)
+	}
+	return
+}
+
 //负责处理文件下载，如果是GET请求将返回下载文件
 //如果是POST请求将返回最新版本和MD5
 func (s *Server) file(w http.ResponseWriter, r *http.Request) {
 	contextLog := s.contextLog.WithField("func", "下载db文件")
-	//首先校验cookie
-	/*
-		if err := s.verify(r); err != nil {
-			contextLog.WithField("msg", "校验Cookie").Errorln(err)
-			w.Write([]byte(err.Error()))
-			return
-		}
-	*/
 	//获取endsn
 	var endsn string
 	v, err := r.Cookie("endsn")
@@ -297,6 +453,11 @@ func (s *Server) file(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	endsn = v.Value
+	if err := s.authenticate(r, endsn); err != nil {
+		contextLog.WithFields(logrus.Fields{"endsn": endsn, "msg": "校验身份"}).Errorln(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	//如果是GET方法则为下载文件
 	if r.Method == "GET" {
 		//找到endsn目录下的easy.db返回
@@ -334,74 +495,6 @@ func (s *Server) file(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) verify(r *http.Request) (err error) {
-	var account, token, verify string
-	var v *http.Cookie
-	//校验cookie
-	if v, err = r.Cookie("account"); err != nil {
-		err = fmt.Errorf("获取 account Cookie 错误 %v", err)
-		return
-	}
-	account = v.Value
-	if v, err = r.Cookie("token"); err != nil {
-		err = fmt.Errorf("获取 token Cookie 错误 %v", err)
-		return
-	}
-	token = v.Value
-	if v, err = r.Cookie("verify"); err != nil {
-		err = fmt.Errorf("获取 verify Cookie 错误 %v", err)
-		return
-	}
-	verify = v.Value
-	err = s.check(account, token, verify)
-	return
-}
-
-type reqToken struct {
-	Account   string `comment:"登录账号"`
-	EpeToken  string `comment:"登录令牌"`
-	EpeVerify string `comment:"登录校验"`
-	EndType   string `comment:"终端类型"`
-	EndCode   string `comment:"终端编号"`
-}
-
-type resToken struct {
-	ErrorNo  string `comment:"错误号"`
-	ErrorMsg string `comment:"错误信息"`
-}
-
-func (s *Server) check(account, token, verify string) (err error) {
-	req := new(reqToken)
-	req.Account = account
-	req.EpeToken = token
-	req.EpeVerify = verify
-	buff, err := json.Marshal(req)
-	if err != nil {
-		err = fmt.Errorf("json 打包错误 %v", err)
-		return
-	}
-	reader := bytes.NewBuffer(buff)
-	resp, err := http.Post("http://www.yireyun.com/sso/verifyEpe", "application/json", reader)
-	if err != nil {
-		err = fmt.Errorf("POST sso/verifyEpe 出错 %v", err)
-		return
-	}
-	buff, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		err = fmt.Errorf("读取r.Bdoy 出错 %v", err)
-		return
-	}
-	res := new(resToken)
-	if err = json.Unmarshal(buff, res); err != nil {
-		err = fmt.Errorf("json 解析出错 %v", err)
-		return
-	}
-	if res.ErrorNo != "0000" {
-		err = fmt.Errorf("服务器返回错误[%s]", res.ErrorMsg)
-	}
-	return
-}
-
 //文件目录默认为file/{endsn}
 //读取指定文件buff
 func (s *Server) findFile(filename string) (buff []byte, err error) {
@@ -420,7 +513,11 @@ func (s *Server) fileMD5(filename string) (value string, err error) {
 }
 
 func main() {
-	s := NewServer()
+	cfg, err := LoadConfig("control.conf")
+	if err != nil {
+		log.Fatalln("加载配置文件出错", err)
+	}
+	s := NewServer(cfg)
 	log.Fatalln(s.ListenAndServe())
 }
 
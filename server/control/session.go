@@ -1,6 +1,9 @@
 package main
 
 import (
+	"easy/control/protocol"
+	"encoding/json"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,112 +18,545 @@ import (
 type session struct {
 	conn   *websocket.Conn
 	status int32
-	//收到消息将放入这里，如果超过最大缓存将丢弃
-	//如果链接断开将重置
-	msgBuff    chan []byte
-	account    string
+	//连接序号，每次SetConn加一，用于判断box是否已经重新连接
+	gen uint64
+	//发送队列，每个连接由一个goroutine写入
+	writer *protocol.Writer
+	//等待返回的请求，主键为消息ID
+	//收到返回报文时根据ID找到对应的请求，找不到将丢弃
+	//如果链接断开将全部返回错误
+	mu      *sync.Mutex
+	pending map[uint32]chan *protocol.Message
+	//最后一次分配的消息ID
+	msgID uint32
+	//握手结果，为空表示旧版本box
+	hello *protocol.Hello
+	//握手完成或确认为旧版本box后关闭
+	ready chan struct{}
+	//已经发送过旧版本报文，之后不能再升级为新版本协议
+	legacyUsed bool
+	//旧版本box没有消息ID，一次只能有一个请求
+	legacyMu *sync.Mutex
+	endsn    string
+	account  string
+	//box上报的事件将发布到这里
+	bus *eventBus
+	//连接断开时调用，记录断开原因，gen为断开的连接序号
+	onStop func(endsn, reason string, gen uint64)
+	//收到设备信息时调用
+	onInfo func(endsn string, info *protocol.BoxInfo)
+	//链路质量统计
+	link       *linkStats
 	contextLog *logrus.Entry
 }
 
-func newSession() *session {
+func newSession(endsn string, bus *eventBus) *session {
 	s := new(session)
+	s.endsn = endsn
+	s.bus = bus
+	s.mu = new(sync.Mutex)
+	s.legacyMu = new(sync.Mutex)
+	s.pending = make(map[uint32]chan *protocol.Message)
+	s.ready = make(chan struct{})
+	s.link = newLinkStats()
 	s.contextLog = logrus.WithField("module", "session")
 	return s
 }
 
-//SetConn 替换原来的conn
+//SetConn 替换原来的conn，需要重新握手
 func (s *session) SetConn(conn *websocket.Conn, account string) {
+	s.mu.Lock()
 	s.conn = conn
+	s.gen++
+	s.writer = protocol.NewWriter(conn, 64)
 	s.account = account
+	s.hello = nil
+	s.ready = make(chan struct{})
+	s.legacyUsed = false
+	s.mu.Unlock()
 }
 
 //Start 启动后将维持心跳，如果两个心跳周期内收不到心跳报文，
 //将断开链接。
+//状态在返回前已经修改，之后Online可以查到此连接
 func (s *session) Start() {
+	if !atomic.CompareAndSwapInt32(&s.status, 0, 1) {
+		s.contextLog.Info("已经启动")
+		return
+	}
 	go s.start()
 }
 
+//Gen 当前连接的序号
+func (s *session) Gen() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gen
+}
+
 //Status 获取当前连接状态
 func (s *session) Status() int32 {
 	status := atomic.LoadInt32(&s.status)
 	return status
 }
 
-func (s *session) start() {
-	if !atomic.CompareAndSwapInt32(&s.status, 0, 1) {
-		s.contextLog.Info("已经启动")
-		return
+//Hello 获取握手结果，旧版本box返回nil
+func (s *session) Hello() *protocol.Hello {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hello
+}
+
+//Supports 判断box是否支持此方法
+func (s *session) Supports(method string) bool {
+	hello := s.Hello()
+	if hello == nil {
+		_, ok := protocol.LegacyCodes[method]
+		return ok
 	}
-	s.msgBuff = make(chan []byte, 1)
+	return protocol.Supported(hello.Methods, method)
+}
+
+//当前的连接
+func (s *session) currentConn() *websocket.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+//当前连接的发送队列
+func (s *session) currentWriter() *protocol.Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writer
+}
+
+func (s *session) start() {
+	//连接被替换后，原来的读取循环退出时不能断开新的连接
+	conn := s.currentConn()
+	writer := s.currentWriter()
+	//5秒内收不到握手报文按旧版本box处理
+	//之后收到的握手报文仍然可以升级为新版本协议，见setHello
+	handshake := time.AfterFunc(5*time.Second, func() {
+		if s.setHello(nil) {
+			s.contextLog.Info("未收到握手报文,按旧版本协议处理")
+		}
+	})
+	defer handshake.Stop()
+
+	//定时发送ping统计链路质量
+	done := make(chan struct{})
+	defer close(done)
+	s.link.Reset(time.Now())
+	go s.probe(writer, done)
 
-	s.conn.SetReadDeadline(time.Now().Add(20 * time.Second))
-	s.conn.SetPingHandler(func(data string) error {
-		s.conn.SetReadDeadline(time.Now().Add(20 * time.Second))
-		if err := s.conn.WriteMessage(websocket.PongMessage, []byte{}); err != nil {
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	conn.SetPongHandler(func(data string) error {
+		s.link.Pong(data, time.Now())
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+		s.link.BoxPing(time.Now())
+		if err := writer.WriteControl(websocket.PongMessage, []byte{}); err != nil {
 			s.contextLog.WithField("msg", "websocket 写入心跳").Errorln(err)
 		}
 		return nil
 	})
 	for {
-		_, msg, err := s.conn.ReadMessage()
+		_, buff, err := conn.ReadMessage()
 		if err != nil {
 			s.contextLog.WithField("msg", "websocket ReadMessage").Errorln(err)
-			s.Stop()
+			s.stop(conn, err.Error())
 			return
 		}
-		select {
-		case s.msgBuff <- msg:
+		var msg *protocol.Message
+		//旧版本报文第一个字节为方法代码，不会是json，迟到的握手报文按新版本解析
+		if s.isLegacy() && (len(buff) == 0 || buff[0] != '{') {
+			msg, err = legacyResponse(buff)
+		} else {
+			msg, err = protocol.Unmarshal(buff)
+		}
+		if err != nil {
+			s.contextLog.WithField("msg", "解析报文").Errorln(err)
+			continue
+		}
+		switch msg.Type {
+		case protocol.TypeHello:
+			s.handshake(conn, msg)
+		case protocol.TypeResponse:
+			s.mu.Lock()
+			ch, ok := s.pending[msg.ID]
+			delete(s.pending, msg.ID)
+			s.mu.Unlock()
+			if !ok {
+				s.contextLog.WithField("id", msg.ID).Info("未找到对应请求,丢弃报文")
+				continue
+			}
+			ch <- msg
+		case protocol.TypeEvent:
+			if msg.Method == protocol.EventInfo {
+				s.updateInfo(msg)
+			} else {
+				s.publish(msg)
+			}
 		default:
+			s.contextLog.WithField("type", msg.Type).Info("未知报文类型,丢弃报文")
+		}
+	}
+}
+
+//定时向box发送ping，根据pong计算往返时延
+func (s *session) probe(writer *protocol.Writer, done chan struct{}) {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			data := s.link.Ping(time.Now())
+			if err := writer.WriteControl(websocket.PingMessage, data); err != nil {
+				s.contextLog.WithField("msg", "websocket 写入ping").Errorln(err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+//Link 获取链路质量，reconnects为最近一小时重连次数
+func (s *session) Link(reconnects int) *LinkQuality {
+	return s.link.Quality(reconnects)
+}
+
+//处理box的握手报文，协商双方都支持的版本和方法
+//版本过低的box将被拒绝并断开
+func (s *session) handshake(conn *websocket.Conn, msg *protocol.Message) {
+	contextLog := s.contextLog.WithField("func", "握手")
+	req := new(protocol.Hello)
+	if err := msg.Decode(req); err != nil {
+		contextLog.WithField("msg", "解析握手报文").Errorln(err)
+		return
+	}
+	res, err := protocol.NewMessage(protocol.TypeHello, msg.ID, "", nil)
+	if err != nil {
+		contextLog.WithField("msg", "生成握手报文").Errorln(err)
+		return
+	}
+	if req.Version < protocol.MinVersion {
+		res.Error = protocol.NewError(protocol.CodeUnsupported, "协议版本[%d]过低,最低支持[%d]", req.Version, protocol.MinVersion)
+		contextLog.Errorln(res.Error)
+		if err = s.write(res); err != nil {
+			contextLog.WithField("msg", "写入握手报文").Errorln(err)
 		}
+		s.stop(conn, res.Error.Msg)
+		return
+	}
+	hello := new(protocol.Hello)
+	hello.Version = req.Version
+	if hello.Version > protocol.Version {
+		hello.Version = protocol.Version
+	}
+	for _, method := range req.Methods {
+		if protocol.Supported(protocol.Methods, method) {
+			hello.Methods = append(hello.Methods, method)
+		}
+	}
+	if !s.setHello(hello) {
+		//已经按旧版本发送过报文，断开连接让box重新连接并握手
+		if s.Hello() == nil {
+			contextLog.Warnln("握手报文过晚,已经按旧版本协议通信,断开连接")
+			s.stop(conn, "握手报文过晚")
+			return
+		}
+		contextLog.Info("重复的握手报文,丢弃")
+		return
+	}
+	if req.Info != nil && s.onInfo != nil {
+		s.onInfo(s.endsn, req.Info)
+	}
+	if res.Body, err = json.Marshal(hello); err != nil {
+		contextLog.WithField("msg", "json 打包").Errorln(err)
+		return
 	}
+	if err = s.write(res); err != nil {
+		contextLog.WithField("msg", "写入握手报文").Errorln(err)
+		return
+	}
+	contextLog.WithFields(logrus.Fields{"version": hello.Version, "methods": hello.Methods}).Info("握手成功")
+}
+
+//将box上报的事件发布给订阅者
+func (s *session) publish(msg *protocol.Message) {
+	s.mu.Lock()
+	account := s.account
+	s.mu.Unlock()
+	ev := &boxEvent{EndSn: s.endsn, Account: account, Name: msg.Method}
+	if err := msg.Decode(&ev.Event); err != nil {
+		s.contextLog.WithFields(logrus.Fields{"msg": "解析事件", "event": msg.Method}).Errorln(err)
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	//未知的级别按info处理
+	if !validLevel(ev.Level) {
+		ev.Level = protocol.LevelInfo
+	}
+	s.bus.Publish(ev)
 }
 
-//Stop 将链接断开
-func (s *session) Stop() {
+//box定时上报的设备信息
+func (s *session) updateInfo(msg *protocol.Message) {
+	ev := new(protocol.Event)
+	info := new(protocol.BoxInfo)
+	if err := msg.Decode(ev); err != nil {
+		s.contextLog.WithField("msg", "解析设备信息").Errorln(err)
+		return
+	}
+	if err := json.Unmarshal(ev.Data, info); err != nil {
+		s.contextLog.WithField("msg", "解析设备信息").Errorln(err)
+		return
+	}
+	if s.onInfo != nil {
+		s.onInfo(s.endsn, info)
+	}
+}
+
+//记录握手结果，只有第一次有效
+//超时按旧版本处理后，如果还没有发送过旧版本报文，迟到的握手报文仍然有效
+func (s *session) setHello(hello *protocol.Hello) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.ready:
+		if hello == nil || s.hello != nil || s.legacyUsed {
+			return false
+		}
+		s.hello = hello
+		return true
+	default:
+	}
+	s.hello = hello
+	close(s.ready)
+	return true
+}
+
+//确认使用旧版本协议发送请求，之后握手报文不再有效
+func (s *session) useLegacy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.ready:
+		if s.hello == nil {
+			s.legacyUsed = true
+			return true
+		}
+	default:
+	}
+	return false
+}
+
+func (s *session) isLegacy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.ready:
+		return s.hello == nil
+	default:
+		return false
+	}
+}
+
+//等待握手完成
+func (s *session) waitReady() (err error) {
+	s.mu.Lock()
+	ready := s.ready
+	s.mu.Unlock()
+	select {
+	case <-ready:
+	case <-time.After(10 * time.Second):
+		err = fmt.Errorf("等待设备握手超时")
+	}
+	return
+}
+
+//Account 获取box的账号
+func (s *session) Account() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.account
+}
+
+//Stop 将链接断开，reason为断开原因
+func (s *session) Stop(reason string) {
+	s.stop(nil, reason)
+}
+
+//断开conn，conn为空时断开当前连接，conn已经被替换时不处理
+//状态修改和连接的读取在同一个锁内，不会断开之后新建的连接
+func (s *session) stop(conn *websocket.Conn, reason string) {
+	s.mu.Lock()
+	if conn != nil && conn != s.conn {
+		s.mu.Unlock()
+		s.contextLog.Info("连接已经被替换")
+		return
+	}
 	if !atomic.CompareAndSwapInt32(&s.status, 1, 0) {
+		s.mu.Unlock()
 		s.contextLog.Info("已经停止")
 		return
 	}
-	if s.conn != nil {
-		s.conn.Close()
+	conn, writer, gen := s.conn, s.writer, s.gen
+	pending := s.pending
+	s.pending = make(map[uint32]chan *protocol.Message)
+	s.mu.Unlock()
+
+	if writer != nil {
+		writer.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	if s.onStop != nil {
+		s.onStop(s.endsn, reason, gen)
+	}
+	//通知所有等待中的请求连接已断开
+	for _, ch := range pending {
+		close(ch)
 	}
 }
 
-//WriteMsg 将写入发送信息，读取返回报文，出错将断开链接
-func (s *session) WirteMsg(sendCode byte, sendMsg string) (resCode byte, resMsg string, err error) {
+//WirteMsg 使用默认超时时间发送请求
+func (s *session) WirteMsg(method string, req, res interface{}) (err error) {
+	return s.WirteMsgTimeout(method, req, res, 10*time.Second)
+}
+
+//WirteMsgTimeout 发送请求并等待ID相同的返回报文，超时将返回错误
+//返回报文的内容将解析到res，box返回的错误将作为err返回
+//同一个session上可以同时有多个请求在等待
+func (s *session) WirteMsgTimeout(method string, req, res interface{}, timeout time.Duration) (err error) {
 	if s.Status() != 1 {
 		err = fmt.Errorf("设备离线状态")
 		return
 	}
-	//读取前如果有前一次的信息先清除
-	select {
-	case <-s.msgBuff:
-	default:
+	if err = s.waitReady(); err != nil {
+		return
+	}
+	if !s.Supports(method) {
+		err = fmt.Errorf("设备不支持此方法[%s],请先升级程序", method)
+		return
+	}
+	var msg *protocol.Message
+	if s.useLegacy() {
+		msg, err = s.requestLegacy(method, req, timeout)
+	} else {
+		msg, err = s.request(method, req, timeout)
+	}
+	if err != nil {
+		return
 	}
-	//加包头
-	buff := make([]byte, len(sendMsg)+1)
-	buff[0] = sendCode
-	copy(buff[1:], []byte(sendMsg))
-	if err = s.conn.WriteMessage(websocket.TextMessage, buff); err != nil {
-		err = fmt.Errorf("websocket WriteMessage 出错 %v", err)
+	if msg.Error != nil {
+		err = msg.Error
 		return
 	}
-	//从buff读取msg，超时将返回错误
-	timer := time.NewTimer(10 * time.Second)
+	if res != nil {
+		err = msg.Decode(res)
+	}
+	return
+}
+
+func (s *session) request(method string, req interface{}, timeout time.Duration) (res *protocol.Message, err error) {
+	id := atomic.AddUint32(&s.msgID, 1)
+	msg, err := protocol.NewMessage(protocol.TypeRequest, id, method, req)
+	if err != nil {
+		return
+	}
+	ch := s.register(id)
+	defer s.unregister(id)
+
+	if err = s.write(msg); err != nil {
+		return
+	}
+	return s.wait(ch, timeout)
+}
+
+//旧版本协议 包类型1字节 + 包体
+//没有消息ID，同一时间只能有一个请求
+func (s *session) requestLegacy(method string, req interface{}, timeout time.Duration) (res *protocol.Message, err error) {
+	s.legacyMu.Lock()
+	defer s.legacyMu.Unlock()
+
+	buff := []byte{protocol.LegacyCodes[method]}
+	if req != nil {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return nil, fmt.Errorf("json 打包出错 %v", err)
+		}
+		buff = append(buff, body...)
+	}
+	ch := s.register(0)
+	defer s.unregister(0)
+
+	if err = s.currentWriter().WriteMessage(websocket.TextMessage, buff); err != nil {
+		err = fmt.Errorf("写入发送队列出错 %v", err)
+		return
+	}
+	return s.wait(ch, timeout)
+}
+
+//将旧版本box的返回报文转换为Message
+func legacyResponse(buff []byte) (msg *protocol.Message, err error) {
+	if len(buff) < 2 {
+		err = fmt.Errorf("收到错误报文")
+		return
+	}
+	msg = &protocol.Message{Type: protocol.TypeResponse}
+	if body := string(buff[1:]); body != "0000" {
+		msg.Error = &protocol.Error{Code: protocol.CodeFailed, Msg: body}
+	}
+	return
+}
+
+func (s *session) register(id uint32) chan *protocol.Message {
+	ch := make(chan *protocol.Message, 1)
+	s.mu.Lock()
+	s.pending[id] = ch
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *session) unregister(id uint32) {
+	s.mu.Lock()
+	delete(s.pending, id)
+	s.mu.Unlock()
+}
+
+//从ch读取返回报文，超时将返回错误
+func (s *session) wait(ch chan *protocol.Message, timeout time.Duration) (msg *protocol.Message, err error) {
+	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
-	var msg []byte
+	var ok bool
 	select {
 	case <-timer.C:
 		err = fmt.Errorf("等待客户端超时")
 		return
-	case msg = <-s.msgBuff:
+	case msg, ok = <-ch:
 	}
-	if len(msg) < 2 {
-		err = fmt.Errorf("收到错误报文")
+	if !ok {
+		err = fmt.Errorf("连接已断开")
+	}
+	return
+}
+
+func (s *session) write(msg *protocol.Message) (err error) {
+	buff, err := protocol.Marshal(msg)
+	if err != nil {
 		return
 	}
-	resCode = msg[0]
-	resMsg = string(msg[1:])
+	if err = s.currentWriter().WriteMessage(websocket.TextMessage, buff); err != nil {
+		err = fmt.Errorf("写入发送队列出错 %v", err)
+	}
 	return
 }
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+//打开终端会话的方式
+const (
+	//TermOwner 新建会话的操作员，断开时会话结束
+	TermOwner = "owner"
+	//TermWrite 加入已有会话，可以输入
+	TermWrite = "write"
+	//TermRead 加入已有会话，只能观看
+	TermRead = "read"
+)
+
+//网页写超时，超时的网页将被断开，不影响其它网页
+const viewerWriteTimeout = 10 * time.Second
+
+//网页发送队列的长度，队列满时认为网页接收过慢并断开
+const viewerQueueSize = 256
+
+var viewerSeq uint64
+
+//termViewer 打开终端会话的网页
+//box的输出发送给会话的全部网页，只有可写的网页能够输入
+//每个网页由一个goroutine发送，慢的网页不影响其它网页
+type termViewer struct {
+	ID       string
+	Operator string
+	Mode     string
+	Joined   time.Time
+	conn     *websocket.Conn
+	out      chan []byte
+	closed   chan struct{}
+	once     *sync.Once
+}
+
+func newTermViewer(conn *websocket.Conn, operator, mode string) *termViewer {
+	v := new(termViewer)
+	v.ID = strconv.FormatUint(atomic.AddUint64(&viewerSeq, 1), 10)
+	v.Operator = operator
+	v.Mode = mode
+	v.Joined = time.Now()
+	v.conn = conn
+	v.out = make(chan []byte, viewerQueueSize)
+	v.closed = make(chan struct{})
+	v.once = new(sync.Once)
+	go v.run()
+	return v
+}
+
+//CanWrite 网页的输入是否发送给box
+func (v *termViewer) CanWrite() bool {
+	return v.Mode != TermRead
+}
+
+//终端输出放入发送队列，队列已满或网页已经断开时返回false
+func (v *termViewer) send(data []byte) bool {
+	select {
+	case <-v.closed:
+		return false
+	default:
+	}
+	select {
+	case v.out <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+//按顺序发送队列中的终端输出，发送失败时断开网页
+//关闭后继续发送队列中剩余的输出，如超时提示，最多等待1秒
+func (v *termViewer) run() {
+	defer v.conn.Close()
+	for {
+		select {
+		case data := <-v.out:
+			v.conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+			if err := v.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				v.Close()
+				return
+			}
+		case <-v.closed:
+			v.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			for {
+				select {
+				case data := <-v.out:
+					if err := v.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+//Close 断开网页，可以多次调用
+func (v *termViewer) Close() {
+	v.once.Do(func() {
+		close(v.closed)
+	})
+}
+
+//Join 加入其他操作员已经打开的终端会话，返回box的管道和会话的录像
+func (s *sshServer) Join(id string, v *termViewer) (channel ssh.Channel, rec *recorder, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		err = fmt.Errorf("终端会话[%s]不存在", id)
+		return
+	}
+	//会话开始录像后才能加入
+	if sess.rec == nil {
+		err = fmt.Errorf("终端会话[%s]尚未打开", id)
+		return
+	}
+	sess.viewers[v.ID] = v
+	return sess.channel, sess.rec, nil
+}
+
+//Leave 网页断开后离开会话
+func (s *sshServer) Leave(id string, v *termViewer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		delete(sess.viewers, v.ID)
+	}
+}
+
+//SetRecorder 会话开始录像，之后其他操作员才能加入
+func (s *sshServer) SetRecorder(id string, rec *recorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		sess.rec = rec
+	}
+}
+
+//Broadcast 将box的输出发送给会话的全部网页，不等待网页发送完成
+//发送队列已满的网页将被断开，data可以在返回后重复使用
+func (s *sshServer) Broadcast(id string, data []byte) {
+	data = append([]byte(nil), data...)
+	var viewers []*termViewer
+	s.mu.Lock()
+	if sess, ok := s.sessions[id]; ok {
+		for _, v := range sess.viewers {
+			viewers = append(viewers, v)
+		}
+	}
+	s.mu.Unlock()
+	for _, v := range viewers {
+		if !v.send(data) {
+			s.contextLog.WithFields(logrus.Fields{"func": "终端输出", "session": id, "viewer": v.ID}).Warnln("网页接收过慢或已经断开")
+			s.Leave(id, v)
+			v.Close()
+		}
+	}
+}
+
+//复制会话的网页列表，按加入时间排序，需要在锁内调用
+func (t *termSession) viewerList() (list []*termViewer) {
+	for _, v := range t.viewers {
+		c := *v
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Joined.Before(list[j].Joined)
+	})
+	return
+}
+
+//读取网页输入写入box管道，只读网页的输入和控制报文将被丢弃
+//网页断开或写入box出错时返回，输入将重置会话的空闲超时
+func (s *Server) termInput(id string, v *termViewer, channel ssh.Channel, rec *recorder) {
+	contextLog := s.contextLog.WithField("func", "终端输入")
+	for {
+		typ, buff, err := v.conn.ReadMessage()
+		if err != nil {
+			contextLog.WithField("msg", "websocket conn ReadMessage").Errorln(err)
+			return
+		}
+		if !v.CanWrite() {
+			continue
+		}
+		//二进制帧为控制报文
+		if typ == websocket.BinaryMessage {
+			ctl, err := parseTermControl(buff)
+			if err != nil {
+				contextLog.WithField("msg", "终端控制报文").Errorln(err)
+				continue
+			}
+			if err = resizeTerminal(channel, ctl.Cols, ctl.Rows); err != nil {
+				contextLog.WithField("msg", "修改终端大小").Errorln(err)
+				return
+			}
+			if err = rec.Write(castResize, castSize(ctl.Cols, ctl.Rows)); err != nil {
+				contextLog.WithField("msg", "录像").Errorln(err)
+			}
+			continue
+		}
+		if err = rec.Write(castInput, buff); err != nil {
+			contextLog.WithField("msg", "录像").Errorln(err)
+		}
+		if _, err = channel.Write(buff); err != nil {
+			contextLog.WithField("msg", "sshServer channel Wirte").Errorln(err)
+			return
+		}
+		s.sshServer.Touch(id)
+	}
+}
+
+//检查打开终端的权限，只读加入也能看到输入的密码，同样需要终端权限
+func (s *Server) allowTerminal(w http.ResponseWriter, r *http.Request, endsn, mode string) bool {
+	switch mode {
+	case TermOwner, TermWrite, TermRead:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	op := operatorFrom(r)
+	if op.Can(PermTerminal) {
+		return true
+	}
+	s.contextLog.WithFields(logrus.Fields{"operator": op.Name, "path": r.URL.Path}).Warnln("没有权限")
+	s.record(r, "terminal."+mode, endsn, r.FormValue("session"), AuditDenied, nil)
+	w.WriteHeader(http.StatusForbidden)
+	return false
+}
+
+//加入其他操作员的终端会话
+func (s *Server) joinTerminal(r *http.Request, v *termViewer, endsn, id string) {
+	contextLog := s.contextLog.WithField("func", "加入终端会话")
+	action := "terminal.join"
+	var sess *termSession
+	for _, t := range s.sshServer.Sessions(endsn) {
+		if t.ID == id {
+			sess = t
+		}
+	}
+	if sess == nil {
+		err := fmt.Errorf("终端会话[%s]不属于设备[%s]", id, endsn)
+		contextLog.Errorln(err)
+		s.record(r, action, endsn, id, AuditFailed, err)
+		return
+	}
+	channel, rec, err := s.sshServer.Join(id, v)
+	if err != nil {
+		contextLog.Errorln(err)
+		s.record(r, action, endsn, id, AuditFailed, err)
+		return
+	}
+	defer s.sshServer.Leave(id, v)
+	start := time.Now()
+	s.record(r, action, endsn, fmt.Sprintf("%s %s 发起人 %s", id, v.Mode, sess.Operator), AuditSuccess, nil)
+	defer func() {
+		s.record(r, "terminal.leave", endsn, fmt.Sprintf("%s 时长 %s", id, time.Since(start).Truncate(time.Second)), AuditSuccess, nil)
+	}()
+	s.termInput(id, v, channel, rec)
+}
+
+//查询设备的终端会话和打开会话的网页
+func (s *Server) terminalList(w http.ResponseWriter, r *http.Request) {
+	contextLog := s.contextLog.WithField("func", "查询终端会话")
+	if err := r.ParseForm(); err != nil {
+		contextLog.WithField("msg", "r.ParseForm").Errorln(err)
+		return
+	}
+	endsn := r.FormValue("endsn")
+	if !s.allowBox(r, endsn) {
+		s.denyBox(w, r, endsn)
+		return
+	}
+	list := s.sshServer.Sessions(endsn)
+	if list == nil {
+		list = []*termSession{}
+	}
+	buff, err := json.Marshal(list)
+	if err != nil {
+		contextLog.WithField("msg", "json 打包").Errorln(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buff)
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"sort"
 
 	"sync"
 
@@ -15,22 +19,84 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+//临时账号的有效时间
+const credentialExpire = time.Minute
+
+//tempCredential ptyReq发给box的临时账号
+type tempCredential struct {
+	Password string
+	//只能打开此endsn的管道
+	EndSn string
+	//临时账号对应的终端会话
+	Session string
+	Expire  time.Time
+}
+
+//termSession 一个网页终端对应一个会话，box为每个会话单独建立ssh连接和伪终端
+type termSession struct {
+	ID       string
+	EndSn    string
+	Operator string
+	Created  time.Time
+	//网页是否已经打开
+	Attached bool
+	//打开时间和最后一次输入的时间
+	Opened    time.Time `json:",omitempty"`
+	LastInput time.Time `json:",omitempty"`
+	//距离超时断开的秒数和原因，查询时填写
+	Remain int64  `json:",omitempty"`
+	Reason string `json:",omitempty"`
+	//打开会话的网页，查询时填写
+	Viewers []*termViewer `json:",omitempty"`
+	conn    *ssh.ServerConn
+	channel ssh.Channel
+	//box的管道和shell准备好后关闭
+	ready chan struct{}
+	//打开会话的网页，主键为网页ID
+	viewers map[string]*termViewer
+	//会话的录像，全部网页共用
+	rec *recorder
+}
+
+//关闭会话的管道、连接和全部网页，需要在锁内调用
+func (t *termSession) close() {
+	for _, v := range t.viewers {
+		v.Close()
+	}
+	if t.channel != nil {
+		t.channel.Close()
+	}
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
+
 type sshServer struct {
-	mu        *sync.Mutex
-	chans     map[string]ssh.Channel
-	cs        map[string]*ssh.ServerConn
+	mu *sync.Mutex
+	//终端会话，主键为会话ID
+	sessions  map[string]*termSession
 	serconfig *ssh.ServerConfig
 	//临时密码,使用过一次以后将重新产生
-	tempPasswd map[string]string
-	contextLog *logrus.Entry
+	//主键为临时用户名
+	tempPasswd map[string]*tempCredential
+	//主机密钥指纹，发送给box校验
+	hostKey string
+	//登录失败限制
+	limiter *loginLimiter
+	//终端空闲超时和最长时长，为0时不限制
+	idle        time.Duration
+	maxDuration time.Duration
+	contextLog  *logrus.Entry
 }
 
-func newSSHServer() *sshServer {
+func newSSHServer(limiter *loginLimiter, idle, maxDuration time.Duration) *sshServer {
 	s := new(sshServer)
+	s.limiter = limiter
+	s.idle = idle
+	s.maxDuration = maxDuration
 	s.mu = new(sync.Mutex)
-	s.chans = make(map[string]ssh.Channel)
-	s.cs = make(map[string]*ssh.ServerConn)
-	s.tempPasswd = make(map[string]string)
+	s.sessions = make(map[string]*termSession)
+	s.tempPasswd = make(map[string]*tempCredential)
 	s.contextLog = logrus.WithField("module", "sshServer")
 	return s
 }
@@ -45,12 +111,7 @@ func (s *sshServer) Start(addr string) (err error) {
 
 	s.serconfig = &ssh.ServerConfig{
 		//这里使用临时分配的用户名和密码
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			if c.User() == "easy" && string(pass) == "easy" {
-				return nil, nil
-			}
-			return nil, fmt.Errorf("password rejected for %q", c.User())
-		},
+		PasswordCallback: s.checkPassword,
 	}
 	//加载ssh私钥
 	privateBytes, err := ioutil.ReadFile("id_rsa")
@@ -65,6 +126,9 @@ func (s *sshServer) Start(addr string) (err error) {
 		return
 	}
 	s.serconfig.AddHostKey(private)
+	s.mu.Lock()
+	s.hostKey = ssh.FingerprintSHA256(private.PublicKey())
+	s.mu.Unlock()
 
 	for {
 		conn, err := listener.Accept()
@@ -76,57 +140,199 @@ func (s *sshServer) Start(addr string) (err error) {
 	}
 }
 
-func (s *sshServer) GetChannel(ctx context.Context, endsn string) (ok bool, channel ssh.Channel) {
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
+//HostKey 返回主机密钥指纹，服务未启动时为空
+func (s *sshServer) HostKey() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hostKey
+}
+
+//NewSession 为operator新建endsn的终端会话，并生成box登录用的临时账号
+//临时账号有效期credentialExpire，只能登录一次
+//超过有效期仍未被网页打开的会话将被清理
+func (s *sshServer) NewSession(endsn, operator string) (sess *termSession, user, password string, err error) {
+	buff := make([]byte, 32)
+	if _, err = rand.Read(buff); err != nil {
+		err = fmt.Errorf("生成临时账号出错 %v", err)
+		return
+	}
+	user = "box-" + hex.EncodeToString(buff[:8])
+	password = hex.EncodeToString(buff[8:24])
+	now := time.Now()
+	sess = new(termSession)
+	sess.ID = hex.EncodeToString(buff[24:])
+	sess.EndSn = endsn
+	sess.Operator = operator
+	sess.Created = now
+	sess.ready = make(chan struct{})
+	sess.viewers = make(map[string]*termViewer)
 
-	for {
-		select {
-		case <-ctx.Done():
-			return false, nil
-		case <-ticker.C:
-			s.mu.Lock()
-			channel, ok = s.chans[endsn]
-			s.mu.Unlock()
-			if ok {
-				return
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, c := range s.tempPasswd {
+		if now.After(c.Expire) {
+			delete(s.tempPasswd, k)
+		}
+	}
+	for id, c := range s.sessions {
+		if !c.Attached && now.Sub(c.Created) > 2*credentialExpire {
+			delete(s.sessions, id)
+			c.close()
+			s.contextLog.WithFields(logrus.Fields{"endsn": c.EndSn, "session": c.ID}).Infoln("终端会话未被打开，已清理")
+		}
+	}
+	s.tempPasswd[user] = &tempCredential{Password: password, EndSn: endsn, Session: sess.ID, Expire: now.Add(credentialExpire)}
+	s.sessions[sess.ID] = sess
+	return
+}
+
+//校验临时账号，无论成功与否账号都将失效
+//校验通过后endsn和会话ID保存在Permissions中，打开管道时检查
+//同一IP或用户连续失败后需要等待，失败次数过多将被锁定，锁定期间不校验密码
+func (s *sshServer) checkPassword(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	keys := []string{ipKey(c.RemoteAddr().String()), userKey(c.User())}
+	if wait, ok := s.limiter.Check(keys...); !ok {
+		return nil, fmt.Errorf("too many failures, retry after %s", wait.Truncate(time.Second))
+	}
+	s.mu.Lock()
+	cred, ok := s.tempPasswd[c.User()]
+	delete(s.tempPasswd, c.User())
+	s.mu.Unlock()
+	if !ok || time.Now().After(cred.Expire) ||
+		subtle.ConstantTimeCompare(pass, []byte(cred.Password)) != 1 {
+		s.contextLog.WithFields(logrus.Fields{"user": c.User(), "addr": c.RemoteAddr()}).Warnln("临时账号校验失败")
+		s.limiter.Fail(keys...)
+		return nil, fmt.Errorf("password rejected for %q", c.User())
+	}
+	s.limiter.Success(keys...)
+	return &ssh.Permissions{Extensions: map[string]string{"endsn": cred.EndSn, "session": cred.Session}}, nil
+}
+
+//GetChannel 等待box打开会话id的管道，只有新建会话的操作员可以打开，且只能打开一次
+//打开后网页v将收到box的输出
+func (s *sshServer) GetChannel(ctx context.Context, id string, v *termViewer) (sess *termSession, err error) {
+	operator := v.Operator
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
+		err = fmt.Errorf("终端会话[%s]不存在", id)
+		return
+	}
+	if sess.Operator != operator {
+		err = fmt.Errorf("终端会话[%s]不属于操作员[%s]", id, operator)
+		return
+	}
+	select {
+	case <-ctx.Done():
+		err = fmt.Errorf("等待终端超时")
+		return
+	case <-sess.ready:
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		err = fmt.Errorf("终端会话[%s]已经关闭", id)
+		return
+	}
+	if sess.Attached {
+		err = fmt.Errorf("终端会话[%s]已经打开", id)
+		return
+	}
+	sess.Attached = true
+	sess.Opened = time.Now()
+	sess.LastInput = sess.Opened
+	sess.viewers[v.ID] = v
+	return
+}
+
+//Close 关闭终端会话，不影响同一box的其它会话
+func (s *sshServer) Close(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		delete(s.sessions, id)
+		sess.close()
+	}
+}
+
+//Sessions 返回endsn当前的终端会话和打开会话的网页，按创建时间排序
+func (s *sshServer) Sessions(endsn string) (list []*termSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		if sess.EndSn == endsn {
+			c := *sess
+			c.Viewers = sess.viewerList()
+			if deadline, reason := s.deadline(sess); !deadline.IsZero() {
+				c.Remain = int64(time.Until(deadline) / time.Second)
+				c.Reason = reason
 			}
+			list = append(list, &c)
 		}
 	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return
 }
 
 func (s *sshServer) handler(conn net.Conn) {
 	contextLog := s.contextLog.WithField("func", "ssh conn 在这里建立")
-	sConn, chans, _, err := ssh.NewServerConn(conn, s.serconfig)
+	sConn, chans, reqs, err := ssh.NewServerConn(conn, s.serconfig)
 	if err != nil {
 		contextLog.WithField("msg", "ssh.NewServerConn").Errorln(err)
 		return
 	}
+	go ssh.DiscardRequests(reqs)
 	//等待客户端5秒,不创建管道就断开
 	var newChannel ssh.NewChannel
 	select {
 	case newChannel = <-chans:
 	case <-time.After(5 * time.Second):
 		contextLog.Info("等待客户端超时,连接断开")
-		conn.Close()
+		sConn.Close()
 		return
 	}
-	//先关闭以前的
+	//每个连接只使用一个管道，后续的管道全部拒绝
+	go func() {
+		for c := range chans {
+			c.Reject(ssh.Prohibited, "only one channel per session")
+		}
+	}()
+	//管道类型为endsn，必须与临时账号绑定的endsn一致
 	endsn := newChannel.ChannelType()
+	id := sConn.Permissions.Extensions["session"]
+	contextLog = contextLog.WithFields(logrus.Fields{"endsn": endsn, "session": id})
+	if endsn != sConn.Permissions.Extensions["endsn"] {
+		contextLog.WithField("user", sConn.User()).Warnln("管道类型与临时账号不一致")
+		newChannel.Reject(ssh.Prohibited, "channel type mismatch")
+		sConn.Close()
+		return
+	}
 	s.mu.Lock()
-	if conn, ok := s.cs[endsn]; ok {
-		if conn != nil {
-			conn.Close()
-		}
+	sess, ok := s.sessions[id]
+	if ok && sess.conn == nil {
+		sess.conn = sConn
+	} else {
+		ok = false
 	}
-	s.cs[endsn] = sConn
 	s.mu.Unlock()
+	if !ok {
+		contextLog.Warnln("终端会话不存在或已经连接")
+		newChannel.Reject(ssh.Prohibited, "session not found")
+		sConn.Close()
+		return
+	}
+	//box断开时清理会话
+	defer s.Close(id)
 
-	channel, _, err := newChannel.Accept()
+	channel, chReqs, err := newChannel.Accept()
 	if err != nil {
 		contextLog.WithField("msg", "channel.Accept").Errorln(err)
 		return
 	}
+	go ssh.DiscardRequests(chReqs)
 	//发送创建伪终端请求
 	var ptyReq = struct {
 		Term   string
@@ -134,8 +340,8 @@ func (s *sshServer) handler(conn net.Conn) {
 		Heigth uint32
 	}{
 		"xterm-color",
-		108,
-		25,
+		defaultCols,
+		defaultRows,
 	}
 
 	f, err := channel.SendRequest("pty-req", true, ssh.Marshal(ptyReq))
@@ -144,7 +350,7 @@ func (s *sshServer) handler(conn net.Conn) {
 		return
 	}
 	if !f {
-		err = fmt.Errorf("客户端拒绝创建终端")
+		contextLog.Errorln("客户端拒绝创建终端")
 		return
 	}
 	f, err = channel.SendRequest("shell", true, nil)
@@ -153,10 +359,12 @@ func (s *sshServer) handler(conn net.Conn) {
 		return
 	}
 	if !f {
-		err = fmt.Errorf("客户端创建shell失败")
+		contextLog.Errorln("客户端创建shell失败")
 		return
 	}
 	s.mu.Lock()
-	s.chans[endsn] = channel
+	sess.channel = channel
 	s.mu.Unlock()
+	close(sess.ready)
+	sConn.Wait()
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//AllAccounts 可以访问全部账号的box
+const AllAccounts = "*"
+
+//CanAccess 是否可以访问account的box
+func (o *operator) CanAccess(account string) bool {
+	for _, a := range o.Accounts {
+		if a == AllAccounts || (a == account && account != "") {
+			return true
+		}
+	}
+	return false
+}
+
+//Covers 是否可以访问accounts中的全部账号，管理操作员时不能超出自己的范围
+func (o *operator) Covers(accounts []string) bool {
+	for _, account := range accounts {
+		if !o.CanAccess(account) {
+			return false
+		}
+	}
+	return true
+}
+
+//Account 获取endsn所属账号，从未连接过的box返回false
+func (r *registry) Account(endsn string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rec, ok := r.boxs[endsn]
+	if !ok {
+		return "", false
+	}
+	return rec.Account, true
+}
+
+//操作员是否可以看到endsn，用于过滤列表
+func (s *Server) visible(r *http.Request, endsn string) bool {
+	op := operatorFrom(r)
+	if op == nil {
+		return false
+	}
+	account, _ := s.boxs.Account(endsn)
+	return op.CanAccess(account)
+}
+
+//检查操作员是否可以操作endsn，越权时只记录审计日志
+//审计日志不填写box所属账号，只有可以访问全部账号的操作员能够看到
+func (s *Server) allowBox(r *http.Request, endsn string) bool {
+	if s.visible(r, endsn) {
+		return true
+	}
+	e := &auditEntry{Time: time.Now(), Action: "access", EndSn: endsn, Detail: r.URL.Path, Result: AuditDenied}
+	if op := operatorFrom(r); op != nil {
+		e.Operator = op.Name
+	}
+	e.Addr, _, _ = net.SplitHostPort(r.RemoteAddr)
+	s.audit.Append(e)
+	return false
+}
+
+//拒绝越权的请求
+func (s *Server) denyBox(w http.ResponseWriter, r *http.Request, endsn string) {
+	s.contextLog.WithFields(logrus.Fields{"endsn": endsn, "path": r.URL.Path}).Warnln("没有权限访问此设备")
+	w.WriteHeader(http.StatusForbidden)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+//终端的默认大小，网页打开后将发送实际大小
+const (
+	defaultCols = 108
+	defaultRows = 25
+	//终端大小上限，防止异常数据
+	maxTermSize = 1000
+)
+
+//asciicast v2 终端大小变化事件
+const castResize = "r"
+
+//termControl 网页终端的控制报文，使用websocket二进制帧发送
+//文本帧为终端输入
+type termControl struct {
+	Type string
+	Cols uint32
+	Rows uint32
+}
+
+//windowChange ssh window-change请求，见RFC 4254 6.7
+type windowChange struct {
+	Cols   uint32
+	Rows   uint32
+	Width  uint32
+	Height uint32
+}
+
+//解析网页终端的控制报文
+func parseTermControl(buff []byte) (ctl *termControl, err error) {
+	ctl = new(termControl)
+	if err = json.Unmarshal(buff, ctl); err != nil {
+		err = fmt.Errorf("解析终端控制报文出错 %v", err)
+		return
+	}
+	switch ctl.Type {
+	case "resize":
+		if ctl.Cols == 0 || ctl.Rows == 0 || ctl.Cols > maxTermSize || ctl.Rows > maxTermSize {
+			err = fmt.Errorf("终端大小错误 %dx%d", ctl.Cols, ctl.Rows)
+		}
+	default:
+		err = fmt.Errorf("未知的终端控制报文 %s", ctl.Type)
+	}
+	return
+}
+
+//通知box修改终端大小
+func resizeTerminal(channel ssh.Channel, cols, rows uint32) error {
+	req := &windowChange{Cols: cols, Rows: rows}
+	if _, err := channel.SendRequest("window-change", false, ssh.Marshal(req)); err != nil {
+		return fmt.Errorf("发送window-change出错 %v", err)
+	}
+	return nil
+}
+
+//录像中的终端大小，格式为 列x行
+func castSize(cols, rows uint32) []byte {
+	return []byte(strconv.Itoa(int(cols)) + "x" + strconv.Itoa(int(rows)))
+}
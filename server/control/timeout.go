@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//终端超时检查间隔
+const termCheckInterval = 5 * time.Second
+
+//终端超时的原因
+const (
+	ReasonIdle = "空闲超时"
+	ReasonMax  = "超过最长时长"
+)
+
+//Touch 记录终端会话最后一次输入的时间
+func (s *sshServer) Touch(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok {
+		sess.LastInput = time.Now()
+	}
+}
+
+//Deadline 返回终端会话超时断开的时间和原因，不限制时返回零值
+func (s *sshServer) Deadline(id string) (deadline time.Time, reason string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return
+	}
+	deadline, reason = s.deadline(sess)
+	return
+}
+
+//计算会话超时的时间，取空闲超时和最长时长中较早的，需要在锁内调用
+func (s *sshServer) deadline(sess *termSession) (deadline time.Time, reason string) {
+	if !sess.Attached {
+		return
+	}
+	if s.idle > 0 {
+		deadline, reason = sess.LastInput.Add(s.idle), ReasonIdle
+	}
+	if s.maxDuration > 0 {
+		if t := sess.Opened.Add(s.maxDuration); deadline.IsZero() || t.Before(deadline) {
+			deadline, reason = t, ReasonMax
+		}
+	}
+	return
+}
+
+//定时检查终端会话，超时后通知全部网页并关闭会话
+//box上的shell在连接断开后退出，box本地也有超时检查
+func (s *Server) watchTerminal(r *http.Request, endsn, id string, done <-chan struct{}) {
+	ticker := time.NewTicker(termCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		deadline, reason, ok := s.sshServer.Deadline(id)
+		if !ok {
+			return
+		}
+		if deadline.IsZero() || time.Now().Before(deadline) {
+			continue
+		}
+		s.contextLog.WithField("func", "终端超时").WithFields(logrus.Fields{"endsn": endsn, "session": id}).Infoln(reason)
+		s.sshServer.Broadcast(id, []byte(fmt.Sprintf("\r\n\x1b[31m终端%s，连接已经断开\x1b[0m\r\n", reason)))
+		s.record(r, "terminal.timeout", endsn, fmt.Sprintf("%s %s", id, reason), AuditSuccess, nil)
+		s.sshServer.Close(id)
+		return
+	}
+}
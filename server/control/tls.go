@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+//TLSConfig 证书配置，Cert为空时不启用TLS
+type TLSConfig struct {
+	//服务端证书和私钥，pem格式
+	Cert string
+	Key  string
+	//签发box证书的CA，配置后box必须提供证书，且证书CN必须与endsn一致
+	//网页不需要提供证书
+	ClientCA string
+}
+
+//Enabled 是否启用TLS
+func (c *TLSConfig) Enabled() bool {
+	return c.Cert != ""
+}
+
+//生成服务端TLS配置，证书在ListenAndServeTLS时加载
+func (c *TLSConfig) serverConfig() (cfg *tls.Config, err error) {
+	cfg = new(tls.Config)
+	cfg.MinVersion = tls.VersionTLS12
+	if c.ClientCA == "" {
+		return
+	}
+	buff, err := ioutil.ReadFile(c.ClientCA)
+	if err != nil {
+		err = fmt.Errorf("读取CA证书出错 %v", err)
+		return
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buff) {
+		err = fmt.Errorf("CA证书 %s 格式错误", c.ClientCA)
+		return
+	}
+	cfg.ClientCAs = pool
+	//网页不带证书，是否必须提供证书由具体的接口检查
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return
+}
+
+//检查box证书，未配置ClientCA时不检查
+func (s *Server) verifyCert(r *http.Request, endsn string) error {
+	if s.cfg.TLS.ClientCA == "" {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("未提供证书")
+	}
+	if cn := r.TLS.PeerCertificates[0].Subject.CommonName; cn != endsn {
+		return fmt.Errorf("证书CN %s 与endsn %s 不一致", cn, endsn)
+	}
+	return nil
+}
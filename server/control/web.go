@@ -2,58 +2,53 @@ package main
 
 import (
 	"easy/cloud/cDb"
+	"easy/control/protocol"
 	"easy/db"
 	"easy/inf/msgNode"
 	pro "easy/inf/msgSys/msProB3"
 	"easy/ui"
 	"encoding/json"
 	"fmt"
+	"html"
+	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	MethodHeart = iota + 1
-	MethodPullConfig
-	MethodPtyReq
-	MethodUpdate
-)
-
 //显示盒子在线列表
 func (s *Server) showBoxList(w http.ResponseWriter, r *http.Request) {
-	//首先验证
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		w.Header().Set("WWW-Authenticate", `Basic realm="Dotcoo User Login"`)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-	account, passwd, ok := r.BasicAuth()
-	if !ok {
-		w.Header().Set("WWW-Authenticate", `Basic realm="Dotcoo User Login"`)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-	if account != "easy" || passwd != "easy" {
-		w.Header().Set("WWW-Authenticate", `Basic realm="Dotcoo User Login"`)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
+	op := operatorFrom(r)
 	var trs []string
-	for endsn, box := range s.boxs {
-		tr := genTr(endsn, box.account, box.Status())
+	for _, rec := range s.boxs.List() {
+		if !op.CanAccess(rec.Account) {
+			continue
+		}
+		j, _ := s.jobs.Latest(rec.EndSn)
+		rec.Terminals = s.sshServer.Sessions(rec.EndSn)
+		tr := genTr(rec, j)
 		trs = append(trs, tr)
 	}
-	page := genPage(trs)
+	var evs []string
+	for _, ev := range s.events.List("") {
+		if !op.CanAccess(ev.Account) {
+			continue
+		}
+		evs = append(evs, genEventTr(ev))
+	}
+	page := genPage(trs, evs)
 	w.Write([]byte(page))
 }
 
 //处理网页传送过来的请求
+//每个请求将新建一个任务，等待任务完成后返回结果，
+//超过等待时间任务将在后台继续执行，通过/jobs查询结果
 func (s *Server) method(w http.ResponseWriter, r *http.Request) {
 	contextLog := s.contextLog.WithField("func", "网页method接口")
 	buff, err := ioutil.ReadAll(r.Body)
@@ -64,122 +59,226 @@ func (s *Server) method(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Method string
 		EndSn  string
+		//离线任务过期时间，单位秒，不填使用默认配置
+		Expire int
+		//方法的参数，由方法决定具体格式，如exec为protocol.ExecReq
+		Params json.RawMessage `json:",omitempty"`
 	}
 	if err = json.Unmarshal(buff, &req); err != nil {
 		contextLog.WithField("msg", "解析json").Errorln(err)
 		return
 	}
-	switch req.Method {
+	fn, wait, ok := s.methodFunc(req.Method, req.EndSn, operatorFrom(r).Name, req.Params)
+	if !ok {
+		contextLog.Errorf("未找到此方法 %s", req.Method)
+		s.writeMethodRes(w, "9999", "没有这个方法", nil)
+		return
+	}
+	if !s.allowBox(r, req.EndSn) {
+		s.writeMethodRes(w, "9999", "没有权限访问此设备", nil)
+		return
+	}
+	action := "method." + req.Method
+	note := methodNote(req.Method, req.Params)
+	if op := operatorFrom(r); !op.Can(methodPerms[req.Method]) {
+		contextLog.WithFields(logrus.Fields{"operator": op.Name, "method": req.Method}).Warnln("没有权限")
+		s.record(r, action, req.EndSn, strings.TrimSpace(note), AuditDenied, nil)
+		s.writeMethodRes(w, "9999", "没有权限", nil)
+		return
+	}
+	//box离线时加入队列，等待box连接后执行
+	if _, ok := s.boxs.Online(req.EndSn); !ok && queueMethods[req.Method] {
+		expire := time.Duration(s.cfg.QueueExpire) * time.Second
+		if req.Expire > 0 {
+			expire = time.Duration(req.Expire) * time.Second
+		}
+		j := s.jobs.Create(req.EndSn, req.Method)
+		j, _ = s.jobs.Queue(j.ID, time.Now().Add(expire))
+		if err = s.queue.Push(j); err != nil {
+			contextLog.WithField("msg", "加入离线队列").Errorln(err)
+			s.jobs.Finish(j.ID, nil, err)
+			s.record(r, action, req.EndSn, j.ID+note, AuditFailed, err)
+			s.writeMethodRes(w, "9999", err.Error(), j)
+			return
+		}
+		s.record(r, action, req.EndSn, j.ID+note, AuditStarted, nil)
+		s.writeMethodRes(w, "0002", "设备离线,任务已加入队列", j)
+		return
+	}
+	j := s.jobs.Create(req.EndSn, req.Method)
+	done := s.jobs.Run(j.ID, fn)
+	select {
+	case <-done:
+	case <-time.After(wait):
+	}
+	j, _ = s.jobs.Get(j.ID)
+	switch j.State {
+	case JobSuccess:
+		s.record(r, action, req.EndSn, j.ID+note, AuditSuccess, nil)
+		s.writeMethodRes(w, "0000", "操作成功", j)
+	case JobFailed:
+		contextLog.WithFields(logrus.Fields{"method": req.Method, "job": j.ID}).Errorln(j.Error)
+		s.record(r, action, req.EndSn, j.ID+note, AuditFailed, fmt.Errorf("%s", j.Error))
+		s.writeMethodRes(w, "9999", j.Error, j)
+	default:
+		s.record(r, action, req.EndSn, j.ID+note, AuditStarted, nil)
+		s.writeMethodRes(w, "0001", "任务已经开始执行", j)
+	}
+}
+
+//审计记录中附加的方法参数，exec记录执行的命令
+func methodNote(method string, params json.RawMessage) string {
+	if method != protocol.MethodExec {
+		return ""
+	}
+	req := new(protocol.ExecReq)
+	if err := json.Unmarshal(params, req); err != nil {
+		return ""
+	}
+	return fmt.Sprintf(" %q", req.Command)
+}
+
+//box离线时可以加入队列的方法
+var queueMethods = map[string]bool{
+	"pushconfig": true,
+	"update":     true,
+}
+
+//根据方法名称生成任务，wait为网页等待任务完成的最长时间
+//operator为发起任务的操作员，离线队列中的任务为空，params为网页提交的参数
+func (s *Server) methodFunc(method, endsn, operator string, params json.RawMessage) (fn func() (json.RawMessage, error), wait time.Duration, ok bool) {
+	wait = 8 * time.Second
+	ok = true
+	switch method {
 	case "genpage":
-		err = s.page(req.EndSn)
+		fn = func() (json.RawMessage, error) { return nil, s.page(endsn) }
 	case "loadconfig":
-		err = s.loadConfig(req.EndSn)
+		fn = func() (json.RawMessage, error) { return nil, s.loadConfig(endsn) }
 	case "pushconfig":
-		err = s.pushConfig(req.EndSn)
+		fn = func() (json.RawMessage, error) { return s.pushConfig(endsn) }
 	case "ptyreq":
-		err = s.ptyReq(req.EndSn)
+		fn = func() (json.RawMessage, error) { return s.ptyReq(endsn, operator) }
 	case "update":
-		err = s.updateBox(req.EndSn)
+		//更新需要下载文件，不等待结果
+		fn = func() (json.RawMessage, error) { return s.updateBox(endsn) }
+		wait = 0
+	case protocol.MethodExec:
+		req := new(protocol.ExecReq)
+		err := json.Unmarshal(params, req)
+		fn = func() (json.RawMessage, error) {
+			if err != nil {
+				return nil, fmt.Errorf("解析exec参数出错 %v", err)
+			}
+			return s.execBox(endsn, req)
+		}
+		//等待命令执行完成
+		wait = req.TimeoutDuration() + 5*time.Second
 	default:
-		contextLog.Errorf("未找到此方法 %s", req.Method)
-		w.Write([]byte("没有这个方法"))
-		return
+		ok = false
 	}
-	if err != nil {
-		contextLog.WithField("method", req.Method).Errorln(err)
-		w.Write([]byte(err.Error()))
-		return
-	}
-	w.Write([]byte("0000"))
+	return
+}
+
+func (s *Server) writeMethodRes(w http.ResponseWriter, code, msg string, j *job) {
+	var res struct {
+		Code string
+		Msg  string
+		Job  *job
+	}
+	res.Code = code
+	res.Msg = msg
+	res.Job = j
+	buff, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buff)
 }
 
 //更新盒子handler
-func (s *Server) updateBox(endsn string) (err error) {
-	box, ok := s.boxs[endsn]
+//box下载更新文件后才会返回，需要等待较长时间
+func (s *Server) updateBox(endsn string) (res json.RawMessage, err error) {
+	box, ok := s.boxs.Get(endsn)
 	if !ok {
 		err = fmt.Errorf("未找到此endsn[%s]", endsn)
 		return
 	}
-	var req struct {
-		Version string
-	}
-	req.Version = "1.0"
-	buff, _ := json.Marshal(req)
-
-	go func() {
-		_, msg, err := box.WirteMsg(MethodUpdate, string(buff))
-		if err != nil {
-			s.contextLog.WithFields(logrus.Fields{"operate": "updatebox", "msg": "box.WriteMsg"}).Errorln(err)
-			return
-		}
-		if msg != "0000" {
-			s.contextLog.WithFields(logrus.Fields{"operate": "updatebox"}).Errorf("客户端返回错误 %s", msg)
-			return
-		}
-	}()
-	err = fmt.Errorf("更新指令已经发送")
+	req := &protocol.UpdateReq{Version: "1.0"}
+	err = box.WirteMsgTimeout(protocol.MethodUpdate, req, &res, 6*time.Minute)
 	return
 }
 
-//推送配置handler
-func (s *Server) pushConfig(endsn string) (err error) {
-	box, ok := s.boxs[endsn]
-	if !ok {
-		err = fmt.Errorf("未找到对应终端")
+//执行命令handler
+//box在超时后结束命令并返回已有的输出，这里多等待一段时间
+func (s *Server) execBox(endsn string, req *protocol.ExecReq) (res json.RawMessage, err error) {
+	if strings.TrimSpace(req.Command) == "" {
+		err = fmt.Errorf("命令不能为空")
 		return
 	}
-	_, msg, err := box.WirteMsg(MethodPullConfig, "pullconifg")
-	if err != nil {
+	box, ok := s.boxs.Get(endsn)
+	if !ok {
+		err = fmt.Errorf("未找到此endsn[%s]", endsn)
 		return
 	}
-	if msg != "0000" {
-		err = fmt.Errorf("%s", msg)
+	err = box.WirteMsgTimeout(protocol.MethodExec, req, &res, req.TimeoutDuration()+10*time.Second)
+	return
+}
+
+//推送配置handler
+func (s *Server) pushConfig(endsn string) (res json.RawMessage, err error) {
+	box, ok := s.boxs.Get(endsn)
+	if !ok {
+		err = fmt.Errorf("未找到对应终端")
 		return
 	}
+	err = box.WirteMsgTimeout(protocol.MethodPullConfig, nil, &res, 5*time.Minute)
 	return
 }
 
 //远程调试handler
-func (s *Server) ptyReq(endsn string) (err error) {
-	box, ok := s.boxs[endsn]
+//每次请求新建一个终端会话，返回会话ID供网页打开
+func (s *Server) ptyReq(endsn, operator string) (res json.RawMessage, err error) {
+	box, ok := s.boxs.Get(endsn)
 	if !ok {
 		err = fmt.Errorf("未找到此endsn[%s]", endsn)
 		return
 	}
-	var res = struct {
-		Addr     string
-		User     string
-		Password string
-	}{
-		"yireyun.com:10001",
-		"easy",
-		"easy",
-	}
-	buff, err := json.Marshal(res)
-	if err != nil {
-		err = fmt.Errorf("json 打包出错 %v", err)
+	//box使用主机密钥指纹校验ssh服务端
+	hostKey := s.sshServer.HostKey()
+	if hostKey == "" {
+		err = fmt.Errorf("ssh服务未启动")
 		return
 	}
-	_, msg, err := box.WirteMsg(MethodPtyReq, string(buff))
+	//每次请求使用新的临时账号，只能使用一次
+	sess, user, password, err := s.sshServer.NewSession(endsn, operator)
 	if err != nil {
 		return
 	}
-	if msg != "0000" {
-		err = fmt.Errorf("服务端返回错误[%s]", msg)
+	req := &protocol.PtyReq{
+		Addr:     "yireyun.com:10001",
+		User:     user,
+		Password: password,
+		HostKey:  hostKey,
+		Session:  sess.ID,
+		//box本地同样检查超时，服务端异常时也能结束shell
+		IdleTimeout: s.cfg.TerminalIdle * 60,
+		MaxDuration: s.cfg.TerminalMax * 60,
+	}
+	if err = box.WirteMsg(protocol.MethodPtyReq, req, nil); err != nil {
+		s.sshServer.Close(sess.ID)
+		err = fmt.Errorf("服务端返回错误[%v]", err)
 		return
 	}
-	return
+	return json.Marshal(struct{ Session string }{sess.ID})
 }
 
 //生成网页handler
 func (s *Server) page(endsn string) (err error) {
-	box, ok := s.boxs[endsn]
+	box, ok := s.boxs.Get(endsn)
 	if !ok {
 		err = fmt.Errorf("未找到此endsn[%s]", endsn)
 		return
 	}
 	p := ui.NewWeb("easy:easy574576@tcp(rdsbai2yuobmen12j0mto502.mysql.rds.aliyuncs.com:3306)/easynode?charset=utf8&timeout=10s")
-	if err = p.GeneratePage(endsn, box.account, "../node/webroot/private/"); err != nil {
+	if err = p.GeneratePage(endsn, box.Account(), "../node/webroot/private/"); err != nil {
 		err = fmt.Errorf("生成网页出错 %v", err)
 		return
 	}
@@ -203,13 +302,13 @@ func (s *Server) loadConfig(endsn string) (err error) {
 		return
 	}
 
-	box, ok := s.boxs[endsn]
+	box, ok := s.boxs.Get(endsn)
 	if !ok {
 		err = fmt.Errorf("未找到此endsn[%s]", endsn)
 		return
 	}
 	data := new(DbRunData)
-	data.Account = box.account
+	data.Account = box.Account()
 	data.EndSn = endsn
 	data.ModifyTime = time.Now()
 	for _, tag := range dbCfg.CfgMdTagVs {
@@ -304,11 +403,23 @@ func (s *Server) sshWeb(w http.ResponseWriter, r *http.Request) {
 		log.Println("未取到正确endsn")
 		return
 	}
+	if !s.allowBox(r, endsn) {
+		s.denyBox(w, r, endsn)
+		return
+	}
+	session := r.FormValue("session")
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = TermOwner
+	}
+	if !s.allowTerminal(w, r, endsn, mode) {
+		return
+	}
 	page := fmt.Sprintf(`<!DOCTYPE html>
 <html lang="en">
 <head>
     <meta charset="UTF-8">
-    <title>Title</title>
+    <title>%s</title>
     <link rel="stylesheet" href="http://aliyun.cdn.yireyun.com/share/css/xterm.css" />
     <script src="http://aliyun.cdn.yireyun.com/share/js/xterm.js"></script>
     <script src="http://aliyun.cdn.yireyun.com/share/js/attach.js" ></script>
@@ -324,9 +435,20 @@ func (s *Server) sshWeb(w http.ResponseWriter, r *http.Request) {
             text-align: center;
         }
 
+        #viewers {
+            height: 3vh;
+            font-size: 0.8em;
+            color: #666;
+        }
+
+        #warning {
+            color: #dd514c;
+            font-weight: bold;
+        }
+
         #terminal-container {
-            width: 800px;
-            height: 450px;
+            width: 100%%;
+            height: 92vh;
             margin: 0 auto;
             padding: 2px;
         }
@@ -339,25 +461,75 @@ func (s *Server) sshWeb(w http.ResponseWriter, r *http.Request) {
     </style>
 </head>
 <body>
+<div id="viewers"><span id="warning"></span> <span id="names"></span></div>
 <div id="terminal-container"></div>
 <script>
 
-    var conn = new WebSocket("ws://yireyun.com:10000/terminal?endsn=%s");
+    var endsn = "%s", session = "%s", mode = "%s";
+    var writable = mode !== "read";
+    var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+    var conn = new WebSocket(scheme + "yireyun.com:10000/terminal?endsn=" + endsn + "&session=" + session + "&mode=" + mode);
     var term;
+    //终端大小变化使用二进制帧发送，文本帧为终端输入
+    //只读网页不发送输入和终端大小
+    function sendResize(size) {
+        if (!writable) {
+            return;
+        }
+        var msg = JSON.stringify({"Type": "resize", "Cols": size.cols, "Rows": size.rows});
+        conn.send(new Blob([msg]));
+    }
+    //显示打开此会话的网页，即将超时断开时显示警告
+    var modeText = {"owner": "发起", "write": "协作", "read": "只读"};
+    var warnBefore = 60;
+    function showViewers() {
+        var xhr = new XMLHttpRequest();
+        xhr.open("GET", "/terminals?endsn=" + endsn);
+        xhr.onload = function () {
+            if (xhr.status !== 200) {
+                return;
+            }
+            var names = [], warning = "";
+            JSON.parse(xhr.responseText).forEach(function (t) {
+                if (t.ID !== decodeURIComponent(session)) {
+                    return;
+                }
+                (t.Viewers || []).forEach(function (v) {
+                    names.push(v.Operator + "(" + modeText[v.Mode] + ")");
+                });
+                if (t.Reason && t.Remain <= warnBefore) {
+                    warning = "终端将在" + Math.max(t.Remain, 0) + "秒后因" + t.Reason + "断开";
+                    if (t.Reason === "空闲超时" && writable) {
+                        warning += "，输入任意内容继续";
+                    }
+                }
+            });
+            var text = "当前连接: " + names.join(" ");
+            if (!writable) {
+                text = "[只读] " + text;
+            }
+            document.getElementById("names").textContent = text;
+            document.getElementById("warning").textContent = warning;
+        };
+        xhr.send();
+    }
     conn.onerror = function () { alert('连接失败') };
     conn.onopen = function () {
         term = new Terminal({
             termName: "xterm-color",
-            cols: 108,
-            rows: 25,
             cursorBlink: true,
             scrollback: 100,
             tabStopWidth: 4
         });
+        term.on('resize', sendResize);
         term.open(document.getElementById('terminal-container'));
+        term.attach(conn, writable);
         term.fit();
-        term.attach(conn);
+        sendResize({cols: term.cols, rows: term.rows});
         term._initialized = true;
+        window.onresize = function () { term.fit(); };
+        showViewers();
+        setInterval(showViewers, 5000);
     };
 	conn.onclose = function() {
 		alert("连接已经断开");
@@ -365,16 +537,21 @@ func (s *Server) sshWeb(w http.ResponseWriter, r *http.Request) {
 	}
 </script>
 </body>
-</html>`, endsn)
+</html>`, html.EscapeString(endsn), url.QueryEscape(endsn), url.QueryEscape(session), mode)
 	w.Write([]byte(page))
 }
 
-func genPage(trs []string) string {
+func genPage(trs, evs []string) string {
 	var table string
 	for _, tr := range trs {
 		table += tr
 		table += "\n"
 	}
+	var events string
+	for _, tr := range evs {
+		events += tr
+		events += "\n"
+	}
 	page := fmt.Sprintf(`<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -412,10 +589,13 @@ func genPage(trs []string) string {
         function sendMsg(method, endsn) {
             var msg = {"Method": method, "EndSn": endsn};
             request("/method", msg, function(data){
-                if (data === "0000") {
+                var res = JSON.parse(data);
+                if (res.Code === "0000") {
                     alert('操作成功');
+                }else if (res.Code === "0001" || res.Code === "0002") {
+                    alert(res.Msg + ',任务ID ' + res.Job.ID);
                 }else {
-                    alert(data);
+                    alert(res.Msg);
                 }
             }, function (msg) {
                 alert("网络出错");
@@ -423,22 +603,33 @@ func genPage(trs []string) string {
         }
 
 		 function configDb(endsn) {
-            window.open("http://www.yireyun.com:10002?db="+endsn+".db", "_blank","top=200,left=400");
+            window.open("http://www.yireyun.com:10002?db="+encodeURIComponent(endsn+".db"), "_blank","top=200,left=400");
         }
 		
 		function openTerminal(method, endsn) {
             var msg = {"Method": method, "EndSn": endsn};
             request("/method", msg, function(data){
-                if (data === "0000") {
-					window.open("http://yireyun.com:10000/sshWeb?endsn="+endsn, "_blank","top=200,left=400,width=833,height=470");
+                var res = JSON.parse(data);
+                if (res.Code === "0000") {
+										//每个终端单独一个会话，互不影响
+					var url = location.protocol+"//yireyun.com:10000/sshWeb?endsn="+encodeURIComponent(endsn)+
+						"&session="+encodeURIComponent(res.Job.Result.Session);
+					window.open(url, "_blank","top=200,left=400,width=833,height=470");
                 }else {
-                    alert(data);
+                    alert(res.Msg);
                 }
             }, function (msg) {
                 alert("网络出错");
             });
 		}
 
+		//加入已经打开的终端会话，mode为read或write
+		function joinTerminal(endsn, session, mode) {
+			var url = location.protocol+"//yireyun.com:10000/sshWeb?endsn="+encodeURIComponent(endsn)+
+				"&session="+encodeURIComponent(session)+"&mode="+mode;
+			window.open(url, "_blank","top=200,left=400,width=833,height=470");
+		}
+
 		function upload() {
             $("#form1").submit();
             var t = setInterval(function() {
@@ -453,15 +644,35 @@ func genPage(trs []string) string {
     </script>
 </head>
 <body>
+<a href="/auditPage">审计日志</a>
+<a href="/recordingPage">终端录像</a>
 <table class="am-table am-table-bordered am-table-radius am-table-hover am-text-nowrap am-scrollable-horizontal">
     <thead>
     <tr>
         <th>Endsn</th>
         <th>账号</th>
         <th>状态</th>
+        <th>设备信息</th>
+        <th>链路质量</th>
         <th>配置操作</th>
         <th>远程管理</th>
         <th>文件操作</th>
+        <th>最近任务</th>
+    </tr>
+    </thead>
+    <tbody>
+    %s
+    </tbody>
+</table>
+<table class="am-table am-table-bordered am-table-radius am-table-compact am-text-nowrap">
+    <caption>最近事件</caption>
+    <thead>
+    <tr>
+        <th>时间</th>
+        <th>Endsn</th>
+        <th>事件</th>
+        <th>级别</th>
+        <th>描述</th>
     </tr>
     </thead>
     <tbody>
@@ -470,22 +681,69 @@ func genPage(trs []string) string {
 </table>
 <iframe id="iframe1" name="frame1" style="display:none;"></iframe>
 </body>
-</html>`, table)
+</html>`, table, events)
 	return page
 }
 
-//根据endsn和account生成每一行
-func genTr(endsn, account string, status int32) string {
+//根据box连接记录生成每一行
+//endsn和account由box提交，文本、js参数和链接分别转义
+func genTr(rec *boxRecord, j *job) string {
+	endsn, account := html.EscapeString(rec.EndSn), html.EscapeString(rec.Account)
+	jsEndsn, urlEndsn := jsAttr(rec.EndSn), url.QueryEscape(rec.EndSn)
 	var s string
-	if status == 1 {
-		s = `<td><span class="am-badge am-badge-success am-round am-text-default">在线</span></td>`
+	if rec.Online {
+		s = fmt.Sprintf(`<td><span class="am-badge am-badge-success am-round am-text-default" title="%s 重连%d次">在线 %s</span></td>`,
+			html.EscapeString(rec.RemoteAddr), rec.Reconnects, sinceText(rec.LastConnect))
 	} else {
-		s = `<td><span class="am-badge am-round am-text-default">离线</span></td>`
+		s = fmt.Sprintf(`<td><span class="am-badge am-round am-text-default" title="%s">离线 %s</span></td>`,
+			html.EscapeString(rec.DisconnectReason), sinceText(rec.LastDisconnect))
+	}
+	infoTd := `<td></td>`
+	//设备信息由box上报，全部需要转义
+	if info := rec.Info; info != nil {
+		e := html.EscapeString
+		infoTd = fmt.Sprintf(`<td title="内核 %s&#10;开机 %s&#10;IP %s&#10;配置MD5 %s&#10;上报时间 %s">%s %s/%s %s</td>`,
+			e(info.Kernel), time.Duration(info.Uptime)*time.Second, e(strings.Join(info.IPs, ",")), e(info.ConfigMD5),
+			info.Time.Format("2006-01-02 15:04:05"), e(info.Version), e(info.GOOS), e(info.GOARCH), e(info.Hostname))
+	}
+	linkTd := `<td></td>`
+	if l := rec.Link; l != nil && l.Samples > 0 {
+		class := "am-badge-success"
+		if l.Degraded {
+			class = "am-badge-danger"
+		}
+		linkTd = fmt.Sprintf(`<td title="最小%dms 最大%dms&#10;心跳丢失%d次&#10;采样%d次"><span class="am-badge %s am-round">%dms 丢包%d%% 重连%d/h</span></td>`,
+			l.MinRTT, l.MaxRTT, l.MissedHeartbeats, l.Samples, class, l.RTT, l.Loss, l.ReconnectsPerHour)
+	}
+	jobTd := `<td></td>`
+	if j != nil {
+		jobTd = fmt.Sprintf(`<td><a href="/jobs?endsn=%s" title="%s">%s %s %s</a></td>`,
+			urlEndsn, html.EscapeString(j.Error), j.Method, jobBadge(j.State), j.Created.Format("01-02 15:04:05"))
+	}
+	//打开的终端会话数量，鼠标悬停显示操作员，可以只读或协作加入已经打开的会话
+	var terms string
+	if n := len(rec.Terminals); n > 0 {
+		var names, joins []string
+		for _, t := range rec.Terminals {
+			var viewers []string
+			for _, v := range t.Viewers {
+				viewers = append(viewers, fmt.Sprintf("%s(%s)", html.EscapeString(v.Operator), v.Mode))
+			}
+			names = append(names, fmt.Sprintf("%s %s %s", html.EscapeString(t.Operator), t.Created.Format("01-02 15:04:05"), strings.Join(viewers, " ")))
+			if t.Attached {
+				joins = append(joins, fmt.Sprintf(`<a href="javascript:;" onclick="joinTerminal('%s', '%s', 'read')">观看 %s</a> <a href="javascript:;" onclick="joinTerminal('%s', '%s', 'write')">协作</a>`,
+					jsEndsn, jsAttr(t.ID), html.EscapeString(t.Operator), jsEndsn, jsAttr(t.ID)))
+			}
+		}
+		terms = fmt.Sprintf(`<span class="am-badge am-badge-warning am-round" title="%s">终端 %d</span> %s`,
+			strings.Join(names, "&#10;"), n, strings.Join(joins, " "))
 	}
 	temp := fmt.Sprintf(`<tr>
         <td>%s</td>
         <td>%s</td>
         %s
+        %s
+        %s
         <td>
             <button class="am-btn am-btn-primary am-btn-sm" onclick="sendMsg('genpage', '%s')">生成网页</button>
             <button class="am-btn am-btn-primary am-btn-sm" onclick="sendMsg('loadconfig', '%s')">云端加载</button>
@@ -496,6 +754,7 @@ func genTr(endsn, account string, status int32) string {
 		<td>
             <button class="am-btn am-btn-primary am-btn-sm" onclick="openTerminal('ptyreq', '%s')">打开终端</button>
             <button class="am-btn am-btn-primary am-btn-sm" onclick="sendMsg('update', '%s')">更新程序</button>
+            %s
 		</td>
 		<td>
             <form id="form1" action="/upload?endsn=%s" method="post" enctype="multipart/form-data" target="frame1">
@@ -503,6 +762,67 @@ func genTr(endsn, account string, status int32) string {
 				<button class="am-btn am-btn-primary am-btn-xs" onclick="upload();">上传</button>
             </form>
         </td>
-    </tr>`, endsn, account, s, endsn, endsn, endsn, endsn, endsn, endsn, endsn, endsn)
+        %s
+    </tr>`, endsn, account, s, infoTd, linkTd, jsEndsn, jsEndsn, jsEndsn, urlEndsn, jsEndsn, jsEndsn, jsEndsn, terms, urlEndsn, jobTd)
 	return temp
 }
+
+//转义为html属性中js字符串的内容，如onclick="f('%s')"
+func jsAttr(s string) string {
+	return html.EscapeString(template.JSEscapeString(s))
+}
+
+//距离t的时长，如3小时、5分钟
+func sinceText(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	d := time.Since(t)
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%d天", d/(24*time.Hour))
+	case d >= time.Hour:
+		return fmt.Sprintf("%d小时", d/time.Hour)
+	case d >= time.Minute:
+		return fmt.Sprintf("%d分钟", d/time.Minute)
+	default:
+		return fmt.Sprintf("%d秒", d/time.Second)
+	}
+}
+
+//根据任务状态生成标签
+func jobBadge(state string) string {
+	var class string
+	switch state {
+	case JobSuccess:
+		class = "am-badge-success"
+	case JobFailed:
+		class = "am-badge-danger"
+	default:
+		class = "am-badge-warning"
+	}
+	return fmt.Sprintf(`<span class="am-badge %s am-round">%s</span>`, class, state)
+}
+
+//生成事件列表的每一行
+//事件内容由box上报，全部需要转义
+func genEventTr(ev *boxEvent) string {
+	var class, level string
+	if validLevel(ev.Level) {
+		level = ev.Level
+	}
+	switch level {
+	case protocol.LevelError:
+		class = "am-danger"
+	case protocol.LevelWarn:
+		class = "am-warning"
+	}
+	return fmt.Sprintf(`<tr class="%s">
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+        <td>%s</td>
+    </tr>`, class, ev.Time.Format("2006-01-02 15:04:05"), html.EscapeString(ev.EndSn), html.EscapeString(ev.Name),
+		level, html.EscapeString(ev.Msg))
+}
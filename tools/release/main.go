@@ -0,0 +1,77 @@
+//release 生成发布密钥和签名发布文件，私钥需要离线保存
+//
+//生成密钥: release -genkey -key release.key
+//签名文件: release -key release.key -goos linux -goarch arm -version 1.0 -file box
+//签名文件保存为 {goos}_{goarch}_{version}.json，需要放到云端 {DataDir}/release 目录下
+//编译box时必须使用 -ldflags "-X main.ReleaseKey=公钥" 指定公钥，ReleaseKey为空的box将拒绝所有更新
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"easy/control/protocol"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+func main() {
+	genkey := flag.Bool("genkey", false, "生成密钥")
+	keyfile := flag.String("key", "release.key", "私钥文件")
+	goos := flag.String("goos", "linux", "GOOS")
+	goarch := flag.String("goarch", "arm", "GOARCH")
+	version := flag.String("version", "", "版本")
+	file := flag.String("file", "box", "发布文件")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "生成密钥: release -genkey -key release.key")
+		fmt.Fprintln(flag.CommandLine.Output(), "签名文件: release -key release.key -goos linux -goarch arm -version 1.0 -file box")
+		fmt.Fprintln(flag.CommandLine.Output(), "编译box时必须使用 -ldflags \"-X main.ReleaseKey=公钥\"，ReleaseKey为空的box将拒绝所有更新")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *genkey {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatalln("生成密钥出错", err)
+		}
+		if err = ioutil.WriteFile(*keyfile, []byte(base64.StdEncoding.EncodeToString(priv.Seed())), 0600); err != nil {
+			log.Fatalln("写入私钥出错", err)
+		}
+		fmt.Printf("公钥 %s\n", base64.StdEncoding.EncodeToString(pub))
+		fmt.Printf("编译box时使用 -ldflags \"-X main.ReleaseKey=%s\"\n", base64.StdEncoding.EncodeToString(pub))
+		fmt.Println("注意: 未指定ReleaseKey的box将拒绝所有更新，发布前请确认编译参数")
+		return
+	}
+	if *version == "" {
+		log.Fatalln("未指定版本")
+	}
+	buff, err := ioutil.ReadFile(*keyfile)
+	if err != nil {
+		log.Fatalln("读取私钥出错", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(string(buff))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		log.Fatalln("私钥格式错误", err)
+	}
+	buff, err = ioutil.ReadFile(*file)
+	if err != nil {
+		log.Fatalln("读取发布文件出错", err)
+	}
+	sum := sha256.Sum256(buff)
+	r := &protocol.Release{GOOS: *goos, GOARCH: *goarch, Version: *version, SHA256: hex.EncodeToString(sum[:])}
+	r.Sign(ed25519.NewKeyFromSeed(seed))
+	if buff, err = json.MarshalIndent(r, "", "\t"); err != nil {
+		log.Fatalln("json 打包出错", err)
+	}
+	name := fmt.Sprintf("%s_%s_%s.json", *goos, *goarch, *version)
+	if err = ioutil.WriteFile(name, buff, 0644); err != nil {
+		log.Fatalln("写入签名文件出错", err)
+	}
+	fmt.Println("签名文件", name)
+}